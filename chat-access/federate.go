@@ -0,0 +1,149 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// What another account shares with us shows up under its public
+// key, e.g. fed.<account>.chat.TEAM.posts.General. Should match
+// chat versions.
+const fedPrefix = "fed.%s"
+
+func federateUsage() {
+	log.Printf("Usage: chat-access federate [-s server] [-aud workspace] -ok operator-key-file [-syscreds creds] account-jwt-file remote-account-jwt-file\n")
+}
+
+// federateMain shares the posts of a workspace between two accounts.
+// Each account exports its posts and the user JWTs chat-access
+// issued, and imports those of the other. Both account JWTs are
+// re-signed with the operator key and saved, and pushed to the
+// account resolver when given system account creds.
+func federateMain(args []string) {
+	fs := flag.NewFlagSet("federate", flag.ExitOnError)
+	server := fs.String("s", "localhost", "NATS System")
+	aud := fs.String("aud", defaultAudience, "Workspace to share, subjects are under chat.<aud>")
+	okFile := fs.String("ok", "", "Operator Signing Key")
+	sysCreds := fs.String("syscreds", "", "System Account Credentials File, to push the accounts")
+	fs.Usage = federateUsage
+	fs.Parse(args)
+
+	if *okFile == "" || fs.NArg() != 2 {
+		federateUsage()
+		os.Exit(1)
+	}
+	okp := loadOperatorKey(*okFile)
+	files := fs.Args()
+	local, remote := loadAccount(files[0]), loadAccount(files[1])
+	if local.Subject == remote.Subject {
+		log.Fatalf("Can not federate account %q with itself", local.Name)
+	}
+
+	ws := &workspace{Audience: strings.ToUpper(*aud)}
+	ws.federate(local, remote)
+	ws.federate(remote, local)
+
+	var sys *nats.Conn
+	if *sysCreds != "" {
+		opts := []nats.Option{nats.Name("Chat-Access Federation")}
+		opts = append(opts, nats.UserCredentials(*sysCreds))
+		nc, err := nats.Connect(*server, opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer nc.Close()
+		sys = nc
+	}
+	for i, acc := range []*jwt.AccountClaims{local, remote} {
+		ajwt, err := acc.Encode(okp)
+		if err != nil {
+			log.Fatalf("Could not sign account %q: %v", acc.Name, err)
+		}
+		if err := ioutil.WriteFile(files[i], []byte(ajwt), 0644); err != nil {
+			log.Fatalf("Could not save account %q: %v", acc.Name, err)
+		}
+		log.Printf("Saved %q to %s", acc.Name, files[i])
+		if sys == nil {
+			continue
+		}
+		if err := pushAccount(sys, acc.Subject, ajwt); err != nil {
+			log.Fatalf("Could not push account %q: %v", acc.Name, err)
+		}
+		log.Printf("Pushed %q to the account resolver", acc.Name)
+	}
+	if sys == nil {
+		log.Printf("No system account connection, account resolver needs manual update")
+	}
+}
+
+// Adds the exports of local and its imports from remote, unless
+// it already has them.
+func (ws *workspace) federate(local, remote *jwt.AccountClaims) {
+	posts := jwt.Subject(ws.subject(postsSub))
+	if !hasExport(local, posts) {
+		local.Exports.Add(&jwt.Export{Name: "chat posts", Subject: posts, Type: jwt.Stream})
+	}
+	if !hasExport(local, idsSubj) {
+		local.Exports.Add(&jwt.Export{Name: "chat ids", Subject: idsSubj, Type: jwt.Service})
+	}
+
+	prefix := fmt.Sprintf(fedPrefix, remote.Subject)
+	if !hasImport(local, remote.Subject, posts) {
+		local.Imports.Add(&jwt.Import{
+			Name:    "chat posts from " + remote.Name,
+			Account: remote.Subject,
+			Subject: posts,
+			To:      jwt.Subject(prefix),
+			Type:    jwt.Stream,
+		})
+	}
+	ids := jwt.Subject(prefix + "." + idsSubj)
+	if !hasImport(local, remote.Subject, ids) {
+		local.Imports.Add(&jwt.Import{
+			Name:    "chat ids from " + remote.Name,
+			Account: remote.Subject,
+			Subject: ids,
+			To:      idsSubj,
+			Type:    jwt.Service,
+		})
+	}
+	log.Printf("%q shares %s with %q", local.Name, posts, remote.Name)
+}
+
+func hasExport(acc *jwt.AccountClaims, subj jwt.Subject) bool {
+	for _, e := range acc.Exports {
+		if e.Subject == subj {
+			return true
+		}
+	}
+	return false
+}
+
+func hasImport(acc *jwt.AccountClaims, from string, subj jwt.Subject) bool {
+	for _, i := range acc.Imports {
+		if i.Account == from && i.Subject == subj {
+			return true
+		}
+	}
+	return false
+}
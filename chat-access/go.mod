@@ -3,7 +3,8 @@ module github.com/connecteverything/oscon2019/chat-access
 go 1.12
 
 require (
-	github.com/nats-io/jwt v0.2.10
-	github.com/nats-io/nats.go v1.8.1
-	github.com/nats-io/nkeys v0.1.0
+	github.com/nats-io/jwt v1.2.2
+	github.com/nats-io/nats-server/v2 v2.2.0
+	github.com/nats-io/nats.go v1.10.1-0.20210228004050-ed743748acac
+	github.com/nats-io/nkeys v0.3.0
 )
@@ -29,7 +29,8 @@ import (
 )
 
 func usage() {
-	log.Printf("Usage: chat-access [-s server] [-acc acc-jwt-file] [-sk signing-key-file] [-creds creds] [-sid label]\n")
+	log.Printf("Usage: chat-access [-s server] [-acc acc-jwt-file] [-sk signing-key-file] [-creds creds] [-sid label] [-names registry-file] [-mods mods-file] [-rate posts-per-min -burst posts] [-ok operator-key-file -admins admins-file -syscreds creds] [-aud workspace | -workspaces file]\n")
+	log.Printf("       chat-access federate [-s server] [-aud workspace] -ok operator-key-file [-syscreds creds] account-jwt-file remote-account-jwt-file\n")
 }
 
 func showUsageAndExit(exitcode int) {
@@ -39,56 +40,69 @@ func showUsageAndExit(exitcode int) {
 
 const (
 	reqSubj    = "chat.req.access"
+	idsSubj    = "chat.req.ids"
 	reqGroup   = "kubecon"
 	maxNameLen = 8
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "federate" {
+		log.SetFlags(0)
+		federateMain(os.Args[2:])
+		return
+	}
+
 	var server = flag.String("s", "localhost", "NATS System")
 	var accFile = flag.String("acc", "", "Account JWT File")
 	var skFile = flag.String("sk", "", "Account Signing Key")
 	var appCreds = flag.String("creds", "", "App Credentials File")
 	var sid = flag.String("sid", "<undisclosed>", "Server ID, e.g. AWS/West")
+	var regFile = flag.String("names", "names.json", "Name Registry File")
+	var okFile = flag.String("ok", "", "Operator Signing Key, enables revocations")
+	var adminsFile = flag.String("admins", "", "Admin Public Keys File")
+	var sysCreds = flag.String("syscreds", "", "System Account Credentials File")
+	var modsFile = flag.String("mods", "", "Moderator Public Keys File")
+	var rate = flag.Int("rate", 0, "Rate limit hint for users, posts per minute")
+	var burst = flag.Int("burst", 5, "Burst allowed with the rate limit hint")
+	var aud = flag.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var wsFile = flag.String("workspaces", "", "Workspaces File, to serve several")
 
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
 
-	if *accFile == "" || *skFile == "" {
-		showUsageAndExit(1)
-	}
-
-	opts := []nats.Option{nats.Name("KubeCon Chat-Access")}
-	opts = setupConnOptions(opts)
-	if *appCreds != "" {
-		opts = append(opts, nats.UserCredentials(*appCreds))
+	// One workspace from the flags, or several from a file.
+	var spaces []*workspace
+	if *wsFile != "" {
+		var err error
+		if spaces, err = loadWorkspaces(*wsFile); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if *accFile == "" || *skFile == "" {
+			showUsageAndExit(1)
+		}
+		spaces = append(spaces, &workspace{
+			Audience: strings.ToUpper(*aud),
+			AccFile:  *accFile,
+			SKFile:   *skFile,
+			Creds:    *appCreds,
+			Names:    *regFile,
+			Mods:     *modsFile,
+			Admins:   *adminsFile,
+			OKFile:   *okFile,
+			SysCreds: *sysCreds,
+		})
 	}
 
-	// Connect to NATS
-	nc, err := nats.Connect(*server, opts...)
-	if err != nil {
-		log.Fatal(err)
-	}
 	log.SetFlags(log.LstdFlags)
-	log.Print("Connected to NATS System")
-
-	// Load account JWT and signing key
-	acc, sk := loadAccountAndSigningKey(*accFile, *skFile)
-
-	// Subscribe to Requests. QueueSubscriber means we can scale
-	// up and down as needed.
-	_, err = nc.QueueSubscribe(reqSubj, reqGroup, func(m *nats.Msg) {
-		if len(m.Data) == 0 {
-			m.Respond([]byte("-ERR 'Name can not be empty'"))
+	for _, ws := range spaces {
+		if ws.Server == "" {
+			ws.Server = *server
 		}
-		reqName := simpleName(m.Data)
-		log.Printf("Registered %q [%q]\n", reqName, m.Data)
-		creds := generateUserCreds(acc, sk, reqName, *sid)
-		m.Respond([]byte(creds))
-	})
-
-	if err != nil {
-		log.Fatal(err)
+		ws.sid = *sid
+		ws.lim = rateLimit{*rate, *burst}
+		ws.serve()
 	}
 
 	// Setup the interrupt handler to drain so we don't
@@ -98,7 +112,9 @@ func main() {
 	<-c
 	log.Println()
 	log.Printf("Draining...")
-	nc.Drain()
+	for _, ws := range spaces {
+		ws.nc.Drain()
+	}
 	log.Fatalf("Exiting")
 
 }
@@ -108,15 +124,20 @@ const (
 	maxMsgSize = 1024
 	validFor   = 365 * 24 * time.Hour
 
-	// Should match chat versions.
-	audience  = "KUBECON"
-	preSub    = "chat.KUBECON."
-	onlineSub = preSub + "online"
-	postsSub  = preSub + "posts.*"
-	dmsPub    = preSub + "dms.*"
-	dmsSub    = preSub + "dms.%s"
+	// Under the workspace, should match chat versions.
+	onlineSub = "online"
+	postsSub  = "posts.*"
+	dmsPub    = "dms.*"
+	dmsSub    = "dms.%s"
+	modSub    = "mod"
+	filesSub  = "files.>"
+	metaSub   = "meta.>"
 	inboxSub  = "_INBOX.>"
 
+	// Rate limit hint tags, should match chat versions.
+	rateTag  = "rate:%d"
+	burstTag = "burst:%d"
+
 	credsT = `
 -----BEGIN NATS USER JWT-----
 %s
@@ -136,6 +157,12 @@ Private NKEYs are sensitive and should be treated as secrets.
 `
 )
 
+// Per user rate limit hint, placed as tags in the user JWT.
+type rateLimit struct {
+	perMin int
+	burst  int
+}
+
 func createNewUserKeys() (string, []byte) {
 	kp, _ := nkeys.CreateUser()
 	pub, _ := kp.PublicKey()
@@ -143,28 +170,127 @@ func createNewUserKeys() (string, []byte) {
 	return pub, priv
 }
 
-func generateUserCreds(acc *jwt.AccountClaims, akp nkeys.KeyPair, name, sid string) string {
+// Registers a new user under a unique name and returns their creds.
+func (ws *workspace) registerUser(reqName []byte) string {
+	name := simpleName(reqName)
+	if name == "" {
+		return "-ERR 'Name can not be empty'"
+	}
+	if isReserved(name) {
+		return fmt.Sprintf("-ERR 'Name %q is reserved'", name)
+	}
+	if ws.reg.owner(name) != "" {
+		return takenResponse(name, ws.reg.suggest(name))
+	}
+
 	pub, priv := createNewUserKeys()
+	ujwt, err := ws.generateUserJWT(pub, name, false)
+	if err != nil {
+		log.Printf("Error generating user JWT: %v", err)
+		return "-ERR 'Internal Error'"
+	}
+	// Someone may have beaten us to it.
+	if err := ws.reg.claim(name, pub, ujwt); err == errNameTaken {
+		return takenResponse(name, ws.reg.suggest(name))
+	} else if err != nil {
+		log.Printf("Error updating name registry: %v", err)
+		return "-ERR 'Internal Error'"
+	}
+	log.Printf("Registered %q [%q] in %s\n", name, reqName, ws.Audience)
+	return fmt.Sprintf(credsT, ujwt, priv, ws.sid)
+}
+
+const (
+	registerClaim = jwt.ClaimType("chat-register")
+	maxReclaimAge = 5 * time.Minute
+)
+
+// Reissues a user JWT for a user nkey we registered, under the name
+// we recorded for it. The request is a claim signed by that nkey, so
+// only the original owner can reclaim a name. We do not know the
+// seed, so we only return the user JWT.
+// This is also how moderators pick up their role once added to -mods.
+func (ws *workspace) reclaimUser(rc *jwt.GenericClaims) string {
+	if rc.Type != registerClaim || !nkeys.IsValidPublicUserKey(rc.Issuer) || rc.Subject != rc.Issuer {
+		return "-ERR 'Invalid reclaim request'"
+	}
+	vr := jwt.CreateValidationResults()
+	rc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return "-ERR 'Invalid reclaim request'"
+	}
+	// Requests need to be short lived so they can't be replayed much later.
+	now := time.Now()
+	if rc.Expires == 0 || time.Unix(rc.Expires, 0).Sub(now) > maxReclaimAge {
+		return "-ERR 'Reclaim request must expire within 5m'"
+	}
+	// Revoked users stay revoked.
+	if ws.rv.isRevoked(rc.Issuer) {
+		return "-ERR 'User has been revoked'"
+	}
+
+	name := ws.reg.nameOf(rc.Issuer)
+	if name == "" {
+		return "-ERR 'Unknown user, register a name first'"
+	}
+	if req := simpleName([]byte(rc.Name)); req != "" && req != name {
+		return fmt.Sprintf("-ERR 'User is registered as %q'", name)
+	}
+	mod := ws.mods.contains(rc.Issuer)
+	ujwt, err := ws.generateUserJWT(rc.Issuer, name, mod)
+	if err != nil {
+		log.Printf("Error generating user JWT: %v", err)
+		return "-ERR 'Internal Error'"
+	}
+	if err := ws.reg.claim(name, rc.Issuer, ujwt); err == errNameTaken {
+		return takenResponse(name, ws.reg.suggest(name))
+	} else if err != nil {
+		return fmt.Sprintf("-ERR '%v'", err)
+	}
+	log.Printf("Reclaimed %q [%s] in %s moderator:%v\n", name, rc.Issuer, ws.Audience, mod)
+	return ujwt
+}
+
+func (ws *workspace) generateUserJWT(pub, name string, mod bool) (string, error) {
 	nuc := jwt.NewUserClaims(pub)
 	nuc.Name = name
 	nuc.Expires = time.Now().Add(validFor).Unix()
 	nuc.Limits.Payload = maxMsgSize
 
 	// Can listen for DMs, but only to ones to ourselves.
-	pubAllow := jwt.StringList{onlineSub, postsSub, dmsPub}
-	subAllow := jwt.StringList{onlineSub, postsSub, fmt.Sprintf(dmsSub, pub), inboxSub}
+	online, posts := ws.subject(onlineSub), ws.subject(postsSub)
+	pubAllow := jwt.StringList{online, posts, ws.subject(dmsPub), idsSubj}
+	subAllow := jwt.StringList{online, posts, ws.subject(dmsSub, pub), inboxSub}
+
+	// Everyone hears moderation, only moderators can moderate.
+	subAllow.Add(ws.subject(modSub))
+
+	// Shared files, their chunks are too big for posts.
+	pubAllow.Add(ws.subject(filesSub))
+	subAllow.Add(ws.subject(filesSub))
+
+	// Channel topics and pins, and asking members for them.
+	pubAllow.Add(ws.subject(metaSub))
+	subAllow.Add(ws.subject(metaSub))
+
+	// Posts other accounts share with us, and their users to verify them.
+	subAllow.Add(fmt.Sprintf(fedPrefix, "*") + "." + posts)
+	pubAllow.Add(fmt.Sprintf(fedPrefix, "*") + "." + idsSubj)
+	if mod {
+		pubAllow.Add(ws.subject(modSub))
+		nuc.Tags.Add(moderatorTag)
+	}
+	// Hint for compliant clients, the server does not enforce it.
+	if ws.lim.perMin > 0 {
+		nuc.Tags.Add(fmt.Sprintf(rateTag, ws.lim.perMin), fmt.Sprintf(burstTag, ws.lim.burst))
+	}
 
 	nuc.Permissions.Pub.Allow = pubAllow
 	nuc.Permissions.Sub.Allow = subAllow
 
-	nuc.IssuerAccount = acc.Subject
+	nuc.IssuerAccount = ws.acc.Subject
 
-	ujwt, err := nuc.Encode(akp)
-	if err != nil {
-		log.Printf("Error generating user JWT: %v", err)
-		return "-ERR 'Internal Error'"
-	}
-	return fmt.Sprintf(credsT, ujwt, priv, sid)
+	return nuc.Encode(ws.sk)
 }
 
 // For demo, first name, max 8 chars and all lower case.
@@ -178,14 +304,7 @@ func simpleName(name []byte) string {
 }
 
 func loadAccountAndSigningKey(accFile, skFile string) (*jwt.AccountClaims, nkeys.KeyPair) {
-	contents, err := ioutil.ReadFile(accFile)
-	if err != nil {
-		log.Fatalf("Could not load account file: %v", err)
-	}
-	acc, err := jwt.DecodeAccountClaims(string(contents))
-	if err != nil {
-		log.Fatalf("Could not decode account: %v", err)
-	}
+	acc := loadAccount(accFile)
 	seed, err := ioutil.ReadFile(skFile)
 	if err != nil {
 		log.Fatalf("Could not load signing key file: %v", err)
@@ -197,6 +316,26 @@ func loadAccountAndSigningKey(accFile, skFile string) (*jwt.AccountClaims, nkeys
 	return acc, kp
 }
 
+func loadAccount(accFile string) *jwt.AccountClaims {
+	acc, err := readAccount(accFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return acc
+}
+
+func readAccount(accFile string) (*jwt.AccountClaims, error) {
+	contents, err := ioutil.ReadFile(accFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load account file: %v", err)
+	}
+	acc, err := jwt.DecodeAccountClaims(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode account: %v", err)
+	}
+	return acc, nil
+}
+
 func setupConnOptions(opts []nats.Option) []nats.Option {
 	totalWait := 10 * time.Minute
 	reconnectDelay := 5 * time.Second
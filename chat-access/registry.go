@@ -0,0 +1,193 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names nobody can register. These are compared after simpleName
+// so truncated forms, e.g. "moderato", are covered as well.
+var reservedNames = []string{
+	"admin", "administrator", "nats", "root", "system",
+	"kubecon", "moderator", "chat", "bot",
+}
+
+// How many alternatives we offer when a name is taken.
+const maxSuggestions = 3
+
+var (
+	errNameTaken = errors.New("name is taken")
+	errHasName   = errors.New("user has a name already")
+)
+
+// registry tracks which user nkey owns which name so that
+// names handed out by chat-access are unique. Each nkey has
+// one name. It is read once, so one chat-access owns the file.
+type registry struct {
+	sync.Mutex
+	path  string
+	names map[string]*regEntry
+}
+
+type regEntry struct {
+	Nkey    string `json:"nkey"`
+	JWT     string `json:"jwt"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+// Loads the registry from disk. A missing file is an empty registry.
+func loadRegistry(path string) (*registry, error) {
+	r := &registry{path: path, names: make(map[string]*regEntry)}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &r.names); err != nil {
+		return nil, fmt.Errorf("could not decode registry %q: %v", path, err)
+	}
+	return r, nil
+}
+
+// Lock should be held.
+func (r *registry) save() error {
+	contents, err := json.MarshalIndent(r.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func isReserved(name string) bool {
+	for _, rn := range reservedNames {
+		if name == simpleName([]byte(rn)) {
+			return true
+		}
+	}
+	return false
+}
+
+// claim registers name to nkey along with the user JWT issued. If the
+// name is already owned by the same nkey this is a reclaim and succeeds.
+// An nkey with another name can not claim this one.
+func (r *registry) claim(name, nkey, ujwt string) error {
+	if isReserved(name) {
+		return fmt.Errorf("name %q is reserved", name)
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now().Unix()
+	if e := r.names[name]; e != nil {
+		if e.Nkey != nkey {
+			return errNameTaken
+		}
+		e.JWT, e.Updated = ujwt, now
+	} else {
+		if n, _ := r.entry(nkey); n != "" {
+			return errHasName
+		}
+		r.names[name] = &regEntry{Nkey: nkey, JWT: ujwt, Created: now, Updated: now}
+	}
+	return r.save()
+}
+
+// Lock should be held. The name of nkey and its entry. Registries
+// from before names were one per nkey may have more, the most
+// recently updated one is it.
+func (r *registry) entry(nkey string) (string, *regEntry) {
+	var name string
+	var entry *regEntry
+	for n, e := range r.names {
+		if e.Nkey != nkey {
+			continue
+		}
+		if entry == nil || e.Updated > entry.Updated || (e.Updated == entry.Updated && n < name) {
+			name, entry = n, e
+		}
+	}
+	return name, entry
+}
+
+// nameOf returns the name registered to nkey, if any.
+func (r *registry) nameOf(nkey string) string {
+	r.Lock()
+	defer r.Unlock()
+	name, _ := r.entry(nkey)
+	return name
+}
+
+// owner returns the nkey that owns name, if any.
+func (r *registry) owner(name string) string {
+	r.Lock()
+	defer r.Unlock()
+	if e := r.names[name]; e != nil {
+		return e.Nkey
+	}
+	return ""
+}
+
+// userJWT returns the last user JWT issued to nkey, if any.
+func (r *registry) userJWT(nkey string) string {
+	r.Lock()
+	defer r.Unlock()
+	if _, e := r.entry(nkey); e != nil {
+		return e.JWT
+	}
+	return ""
+}
+
+// suggest returns some free alternatives for a taken name,
+// e.g. wally2, wally3. Results obey maxNameLen.
+func (r *registry) suggest(name string) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var alts []string
+	for i := 2; i < 1000 && len(alts) < maxSuggestions; i++ {
+		sfx := fmt.Sprintf("%d", i)
+		base := name
+		if len(base)+len(sfx) > maxNameLen {
+			base = base[:maxNameLen-len(sfx)]
+		}
+		alt := base + sfx
+		if r.names[alt] == nil && !isReserved(alt) {
+			alts = append(alts, alt)
+		}
+	}
+	return alts
+}
+
+// Formats the error response for a taken name.
+func takenResponse(name string, alts []string) string {
+	if len(alts) == 0 {
+		return fmt.Sprintf("-ERR 'Name %q is taken'", name)
+	}
+	return fmt.Sprintf("-ERR 'Name %q is taken, try: %s'", name, strings.Join(alts, ", "))
+}
@@ -0,0 +1,170 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	revokeSubj     = "chat.req.revoke"
+	revokeClaim    = jwt.ClaimType("chat-revoke")
+	maxRevokeAge   = 5 * time.Minute
+	claimUpdateSub = "$SYS.REQ.ACCOUNT.%s.CLAIMS.UPDATE"
+	resolverWait   = 5 * time.Second
+)
+
+// revoker adds users to the account's revocation list, re-signs the
+// account JWT with the operator key and pushes it to the resolver.
+type revoker struct {
+	sync.RWMutex
+	acc     *jwt.AccountClaims
+	accFile string
+	okp     nkeys.KeyPair
+	sys     *nats.Conn
+	admins  keySet
+}
+
+func newRevoker(acc *jwt.AccountClaims, accFile, okFile string, admins keySet, sys *nats.Conn) *revoker {
+	okp := loadOperatorKey(okFile)
+	if len(admins) == 0 {
+		log.Printf("Warning: no admins configured, revocations will be refused")
+	}
+	return &revoker{acc: acc, accFile: accFile, okp: okp, sys: sys, admins: admins}
+}
+
+func loadOperatorKey(okFile string) nkeys.KeyPair {
+	seed, err := ioutil.ReadFile(okFile)
+	if err != nil {
+		log.Fatalf("Could not load operator key file: %v", err)
+	}
+	okp, err := nkeys.FromSeed(bytes.TrimSpace(seed))
+	if err != nil {
+		log.Fatalf("Could not decode operator key: %v", err)
+	}
+	return okp
+}
+
+func (rv *revoker) isRevoked(nkey string) bool {
+	if rv == nil {
+		return false
+	}
+	rv.RLock()
+	defer rv.RUnlock()
+	_, ok := rv.acc.Revocations[nkey]
+	return ok
+}
+
+// Processes a signed revocation request from an admin. The subject
+// of the claim is the user public key or a registered name.
+func (rv *revoker) processRequest(reg *registry, data []byte) string {
+	rc, err := jwt.DecodeGeneric(string(data))
+	if err != nil || rc.Type != revokeClaim {
+		return "-ERR 'Invalid revocation request'"
+	}
+	vr := jwt.CreateValidationResults()
+	rc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return "-ERR 'Invalid revocation request'"
+	}
+	if rc.Expires == 0 || time.Until(time.Unix(rc.Expires, 0)) > maxRevokeAge {
+		return "-ERR 'Revocation request must expire within 5m'"
+	}
+	if !rv.admins.contains(rc.Issuer) {
+		log.Printf("Refused revocation of %q from non-admin [%s]", rc.Subject, rc.Issuer)
+		return "-ERR 'Not authorized'"
+	}
+
+	target := rc.Subject
+	if !nkeys.IsValidPublicUserKey(target) {
+		if target = reg.owner(simpleName([]byte(target))); target == "" {
+			return fmt.Sprintf("-ERR 'Unknown user %q'", rc.Subject)
+		}
+	}
+	if err := rv.revoke(target); err != nil {
+		log.Printf("Error revoking %s: %v", target, err)
+		return fmt.Sprintf("-ERR '%v'", err)
+	}
+	log.Printf("Revoked %q [%s] by [%s]", rc.Subject, target, rc.Issuer)
+	return "+OK"
+}
+
+// revoke re-signs the account with nkey revoked, saves it and
+// pushes it to the account resolver.
+func (rv *revoker) revoke(nkey string) error {
+	rv.Lock()
+	defer rv.Unlock()
+
+	// Nothing changes unless the account file does.
+	prev, had := rv.acc.Revocations[nkey]
+	undo := func() {
+		if had {
+			rv.acc.Revocations[nkey] = prev
+		} else {
+			rv.acc.ClearRevocation(nkey)
+		}
+	}
+	rv.acc.Revoke(nkey)
+	ajwt, err := rv.acc.Encode(rv.okp)
+	if err != nil {
+		undo()
+		return fmt.Errorf("could not sign account: %v", err)
+	}
+	if err := ioutil.WriteFile(rv.accFile, []byte(ajwt), 0644); err != nil {
+		undo()
+		return fmt.Errorf("could not save account: %v", err)
+	}
+	if rv.sys == nil {
+		log.Printf("No system account connection, account resolver needs manual update")
+		return nil
+	}
+	return pushAccount(rv.sys, rv.acc.Subject, ajwt)
+}
+
+// Response from the server's account resolver.
+type resolverResponse struct {
+	Data *struct {
+		Message string `json:"message"`
+	} `json:"data,omitempty"`
+	Error *struct {
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// pushAccount sends the account JWT to the full resolver.
+func pushAccount(sys *nats.Conn, account, ajwt string) error {
+	subj := fmt.Sprintf(claimUpdateSub, account)
+	resp, err := sys.Request(subj, []byte(ajwt), resolverWait)
+	if err != nil {
+		return fmt.Errorf("could not update account resolver: %v", err)
+	}
+	var rr resolverResponse
+	if err := json.Unmarshal(resp.Data, &rr); err != nil {
+		return fmt.Errorf("bad response from account resolver: %v", err)
+	}
+	if rr.Error != nil {
+		return fmt.Errorf("account resolver: %s", rr.Error.Description)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Writes a creds file for a new user of the account.
+func testCreds(t *testing.T, dir string, akp nkeys.KeyPair, name string) (string, string) {
+	t.Helper()
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	seed, _ := kp.Seed()
+	uc := jwt.NewUserClaims(pub)
+	uc.Name = name
+	ujwt, err := uc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Could not sign user: %v", err)
+	}
+	creds, err := jwt.FormatUserConfig(ujwt, seed)
+	if err != nil {
+		t.Fatalf("Could not format creds: %v", err)
+	}
+	file := filepath.Join(dir, name+".creds")
+	if err := ioutil.WriteFile(file, creds, 0600); err != nil {
+		t.Fatalf("Could not write creds: %v", err)
+	}
+	return file, pub
+}
+
+// Signs a new account with the operator key.
+func testAccount(t *testing.T, okp nkeys.KeyPair, name string) (nkeys.KeyPair, *jwt.AccountClaims, string) {
+	t.Helper()
+	akp, _ := nkeys.CreateAccount()
+	pub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(pub)
+	ac.Name = name
+	ajwt, err := ac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Could not sign account: %v", err)
+	}
+	return akp, ac, ajwt
+}
+
+// Revokes a user through a server with a full account resolver, the
+// way chat-access does, and checks the server no longer lets them in.
+func TestRevokeFullResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	okp, _ := nkeys.CreateOperator()
+	opub, _ := okp.PublicKey()
+	oc := jwt.NewOperatorClaims(opub)
+	oc.Name = "TEST"
+	ojwt, err := oc.Encode(okp)
+	if err != nil {
+		t.Fatalf("Could not sign operator: %v", err)
+	}
+	skp, sc, sjwt := testAccount(t, okp, "SYS")
+	akp, ac, ajwt := testAccount(t, okp, "CHAT")
+
+	conf := filepath.Join(dir, "server.conf")
+	err = ioutil.WriteFile(conf, []byte(fmt.Sprintf(`
+listen: "127.0.0.1:-1"
+operator: %q
+system_account: %q
+resolver: {
+	type: full
+	dir: %q
+}
+resolver_preload: {
+	%s: %q
+	%s: %q
+}
+`, ojwt, sc.Subject, filepath.Join(dir, "jwt"), sc.Subject, sjwt, ac.Subject, ajwt)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := server.ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Could not load server config: %v", err)
+	}
+	opts.NoLog, opts.NoSigs = true, true
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Server not ready")
+	}
+	url := s.ClientURL()
+
+	sysCreds, _ := testCreds(t, dir, skp, "sys")
+	sys, err := nats.Connect(url, nats.UserCredentials(sysCreds))
+	if err != nil {
+		t.Fatalf("Could not connect system user: %v", err)
+	}
+	defer sys.Close()
+
+	userCreds, upub := testCreds(t, dir, akp, "alice")
+	closed := make(chan struct{})
+	nc, err := nats.Connect(url, nats.UserCredentials(userCreds),
+		nats.NoReconnect(), nats.ClosedHandler(func(*nats.Conn) { close(closed) }))
+	if err != nil {
+		t.Fatalf("Could not connect user: %v", err)
+	}
+	defer nc.Close()
+
+	accFile := filepath.Join(dir, "chat.jwt")
+	if err := ioutil.WriteFile(accFile, []byte(ajwt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rv := &revoker{acc: ac, accFile: accFile, okp: okp, sys: sys}
+	if err := rv.revoke(upub); err != nil {
+		t.Fatalf("Could not revoke: %v", err)
+	}
+	if !rv.isRevoked(upub) {
+		t.Fatal("User not revoked")
+	}
+	saved, err := readAccount(accFile)
+	if err != nil {
+		t.Fatalf("Could not read saved account: %v", err)
+	}
+	if _, ok := saved.Revocations[upub]; !ok {
+		t.Fatal("Revocation not saved to the account file")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Revoked user still connected")
+	}
+	if nc, err := nats.Connect(url, nats.UserCredentials(userCreds)); err == nil {
+		nc.Close()
+		t.Fatal("Revoked user could connect")
+	}
+}
+
+// A revocation that can not be saved leaves the account as it was.
+func TestRevokeUnsaved(t *testing.T) {
+	okp, _ := nkeys.CreateOperator()
+	_, ac, _ := testAccount(t, okp, "CHAT")
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+
+	rv := &revoker{acc: ac, accFile: filepath.Join(os.DevNull, "chat.jwt"), okp: okp}
+	if err := rv.revoke(upub); err == nil {
+		t.Fatal("Expected an error saving the account")
+	}
+	if rv.isRevoked(upub) {
+		t.Fatal("Revocation kept after the account could not be saved")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Tag placed in the user JWT of moderators. The chat client
+// only honors moderation claims from users carrying it.
+const moderatorTag = "moderator"
+
+// keySet is a set of user public keys.
+type keySet map[string]struct{}
+
+func (ks keySet) contains(nkey string) bool {
+	_, ok := ks[nkey]
+	return ok
+}
+
+// Loads user public keys, one per line. Empty lines and
+// lines starting with '#' are skipped.
+func loadKeys(file string) (keySet, error) {
+	ks := make(keySet)
+	if file == "" {
+		return ks, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := string(bytes.TrimSpace(scanner.Bytes()))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !nkeys.IsValidPublicUserKey(line) {
+			return nil, fmt.Errorf("%q is not a user public key", line)
+		}
+		ks[line] = struct{}{}
+	}
+	return ks, scanner.Err()
+}
@@ -0,0 +1,192 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const defaultAudience = "KUBECON"
+
+// workspace is a chat for one audience in its own account. We
+// hand out users for it with permissions under chat.<audience>.
+// With -workspaces we serve several of them, each from a JSON
+// entry like
+//
+//	{"audience": "TEAM", "acc": "team.jwt", "sk": "team.nk", "creds": "access.creds"}
+type workspace struct {
+	Audience string `json:"audience"`
+	Server   string `json:"server,omitempty"`
+	AccFile  string `json:"acc"`
+	SKFile   string `json:"sk"`
+	Creds    string `json:"creds,omitempty"`
+	Names    string `json:"names,omitempty"`
+	Mods     string `json:"mods,omitempty"`
+	Admins   string `json:"admins,omitempty"`
+	OKFile   string `json:"ok,omitempty"`
+	SysCreds string `json:"syscreds,omitempty"`
+
+	sid string
+	lim rateLimit
+
+	nc   *nats.Conn
+	acc  *jwt.AccountClaims
+	sk   nkeys.KeyPair
+	reg  *registry
+	mods keySet
+	rv   *revoker
+}
+
+// Loads the workspaces we serve, a JSON list. Requests for names
+// and ids are on the same subjects in every workspace, so each
+// needs its own account for them to reach the right one.
+func loadWorkspaces(file string) ([]*workspace, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var spaces []*workspace
+	if err := json.Unmarshal(contents, &spaces); err != nil {
+		return nil, fmt.Errorf("could not decode workspaces %q: %v", file, err)
+	}
+	auds := make(map[string]bool)
+	accs := make(map[string]string)
+	for _, ws := range spaces {
+		ws.Audience = strings.ToUpper(ws.Audience)
+		if ws.Audience == "" || ws.AccFile == "" || ws.SKFile == "" {
+			return nil, fmt.Errorf("workspaces in %q need an audience, acc and sk", file)
+		}
+		if auds[ws.Audience] {
+			return nil, fmt.Errorf("workspace %q twice in %q", ws.Audience, file)
+		}
+		auds[ws.Audience] = true
+		acc, err := readAccount(ws.AccFile)
+		if err != nil {
+			return nil, fmt.Errorf("workspace %q: %v", ws.Audience, err)
+		}
+		if other, ok := accs[acc.Subject]; ok {
+			return nil, fmt.Errorf("workspaces %q and %q in %q share account %q", other, ws.Audience, file, acc.Subject)
+		}
+		accs[acc.Subject] = ws.Audience
+		// Names are unique per workspace.
+		if ws.Names == "" {
+			ws.Names = "names-" + strings.ToLower(ws.Audience) + ".json"
+		}
+	}
+	return spaces, nil
+}
+
+// Should match the chat version.
+func (ws *workspace) subject(suffix string, args ...interface{}) string {
+	return "chat." + ws.Audience + "." + fmt.Sprintf(suffix, args...)
+}
+
+// Connects and starts answering requests for the workspace.
+func (ws *workspace) serve() {
+	opts := []nats.Option{nats.Name(ws.Audience + " Chat-Access")}
+	opts = setupConnOptions(opts)
+	if ws.Creds != "" {
+		opts = append(opts, nats.UserCredentials(ws.Creds))
+	}
+
+	// Connect to NATS
+	nc, err := nats.Connect(ws.Server, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ws.nc = nc
+	log.Printf("Connected to NATS System for %s", ws.Audience)
+
+	// Load account JWT and signing key
+	ws.acc, ws.sk = loadAccountAndSigningKey(ws.AccFile, ws.SKFile)
+
+	// Load the names we have already handed out.
+	if ws.reg, err = loadRegistry(ws.Names); err != nil {
+		log.Fatalf("Could not load name registry: %v", err)
+	}
+
+	// Admins and moderators, admins moderate as well.
+	admins, err := loadKeys(ws.Admins)
+	if err != nil {
+		log.Fatalf("Could not load admins: %v", err)
+	}
+	if ws.mods, err = loadKeys(ws.Mods); err != nil {
+		log.Fatalf("Could not load moderators: %v", err)
+	}
+	for k := range admins {
+		ws.mods[k] = struct{}{}
+	}
+
+	// Revocations need the operator key to re-sign the account.
+	if ws.OKFile != "" {
+		var sys *nats.Conn
+		if ws.SysCreds != "" {
+			sopts := []nats.Option{nats.Name(ws.Audience + " Chat-Access System")}
+			sopts = setupConnOptions(sopts)
+			sopts = append(sopts, nats.UserCredentials(ws.SysCreds))
+			if sys, err = nats.Connect(ws.Server, sopts...); err != nil {
+				log.Fatal(err)
+			}
+		}
+		ws.rv = newRevoker(ws.acc, ws.AccFile, ws.OKFile, admins, sys)
+		_, err = nc.QueueSubscribe(revokeSubj, reqGroup, func(m *nats.Msg) {
+			m.Respond([]byte(ws.rv.processRequest(ws.reg, m.Data)))
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Subscribe to Requests. The registry is in memory and only
+	// written out, so run one instance per workspace, instances
+	// sharing a registry file would overwrite each other's names.
+	// Serve the user JWTs we issued, so clients can verify
+	// who signed the posts they receive.
+	_, err = nc.QueueSubscribe(idsSubj, reqGroup, func(m *nats.Msg) {
+		nkey := string(m.Data)
+		ujwt := ws.reg.userJWT(nkey)
+		if ujwt == "" || ws.rv.isRevoked(nkey) {
+			m.Respond([]byte("-ERR 'Unknown user'"))
+			return
+		}
+		m.Respond([]byte(ujwt))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = nc.QueueSubscribe(reqSubj, reqGroup, func(m *nats.Msg) {
+		if len(m.Data) == 0 {
+			m.Respond([]byte("-ERR 'Name can not be empty'"))
+			return
+		}
+		// Owners reclaim their name with a signed request.
+		if rc, err := jwt.DecodeGeneric(string(m.Data)); err == nil {
+			m.Respond([]byte(ws.reclaimUser(rc)))
+			return
+		}
+		m.Respond([]byte(ws.registerUser(m.Data)))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cmdPrefix = "/"
+
+	// Posts loaded from history with /more.
+	defaultMore = 50
+)
+
+// Returns true if the input line is a command. Lines starting
+// with "//" are posted as is, minus the first slash. Actions
+// with /me are posts.
+func isCommand(line string) bool {
+	return strings.HasPrefix(line, cmdPrefix) && !strings.HasPrefix(line, cmdPrefix+cmdPrefix) &&
+		!strings.HasPrefix(line, actionPrefix)
+}
+
+// Returns what we post for an input line that is not a command.
+func postText(line string) string {
+	if strings.HasPrefix(line, cmdPrefix+cmdPrefix) {
+		return line[len(cmdPrefix):]
+	}
+	return line
+}
+
+// Assume lock is held. Called from the UI goroutine.
+func (s *state) processCommand(line string) {
+	args := strings.Fields(line)
+	switch args[0] {
+	case "/mod":
+		s.moderate(args[1:])
+	case "/block", "/unblock":
+		s.block(args[0] == "/block", args[1:])
+	case "/mute", "/unmute":
+		s.muteChannel(args[0] == "/mute", args[1:])
+	case "/more":
+		n := defaultMore
+		if len(args) > 1 {
+			n, _ = strconv.Atoi(args[1])
+		}
+		s.showOlder(n)
+	case "/diag":
+		s.toggleDiagnostics(args[1:])
+	case "/reload":
+		s.app.reloadConfig(s)
+	case "/export":
+		s.export(args[1:])
+	case "/upload":
+		s.upload(args[1:])
+	case "/download":
+		s.download(args[1:])
+	case "/topic":
+		s.setTopic(args[1:])
+	case "/pin", "/unpin":
+		s.pin(args[0] == "/pin", args[1:])
+	case "/pins":
+		s.togglePins()
+	default:
+		s.showInfo("Unknown command %q", args[0])
+	}
+}
+
+const modUsage = "Usage: /mod delete <user> [n] | mute <user> <duration> | kick <user> | readonly on|off"
+
+// Assume lock is held.
+func (s *state) moderate(args []string) {
+	if !s.isModerator() {
+		s.showInfo("You are not a moderator")
+		return
+	}
+	if s.cur == nil || s.cur.kind != channel {
+		s.showInfo("Moderation only applies to channels")
+		return
+	}
+	if len(args) < 2 {
+		s.showInfo(modUsage)
+		return
+	}
+
+	ch := s.cur.name
+	switch args[0] {
+	case modDelete:
+		u := s.lookupUser(args[1])
+		if u == nil {
+			s.showInfo("Unknown user %q", args[1])
+			return
+		}
+		n := 1
+		if len(args) > 2 {
+			n, _ = strconv.Atoi(args[2])
+		}
+		// Find the nth most recent post from the user.
+		posts := s.posts[ch].slice()
+		for i := len(posts) - 1; i >= 0; i-- {
+			if posts[i].Issuer == u.nkey {
+				if n--; n == 0 {
+					mc := s.newModClaim(ch, modDelete)
+					mc.Data["target"] = posts[i].ID
+					s.sendModeration(mc)
+					return
+				}
+			}
+		}
+		s.showInfo("No such post from %q", args[1])
+	case modMute, "kick":
+		u := s.lookupUser(args[1])
+		if u == nil {
+			s.showInfo("Unknown user %q", args[1])
+			return
+		}
+		d := kickFor
+		if args[0] == "kick" {
+			ch = allChannels
+		} else {
+			var err error
+			if len(args) < 3 {
+				s.showInfo(modUsage)
+				return
+			}
+			if d, err = time.ParseDuration(args[2]); err != nil {
+				s.showInfo("Bad duration %q: %v", args[2], err)
+				return
+			}
+		}
+		mc := s.newModClaim(ch, modMute)
+		mc.Data["target"] = u.nkey
+		mc.Data["until"] = time.Now().Add(d).Unix()
+		s.sendModeration(mc)
+	case modReadOnly:
+		mc := s.newModClaim(ch, modReadOnly)
+		mc.Data["on"] = args[1] == "on"
+		s.sendModeration(mc)
+	default:
+		s.showInfo(modUsage)
+	}
+}
+
+// Assume lock is held. Blocks are by nkey, the name is only
+// kept so we can show and unblock by it.
+func (s *state) block(on bool, args []string) {
+	if len(args) != 1 {
+		s.showInfo("Usage: /block <user> | /unblock <user>")
+		return
+	}
+	name := strings.TrimPrefix(args[0], userPrefix)
+	var nkey string
+	if u := s.lookupUser(name); u != nil {
+		nkey = u.nkey
+	} else if !on {
+		nkey = s.prefs.blockedByName(name)
+	}
+	if nkey == "" {
+		s.showInfo("Unknown user %q", name)
+		return
+	}
+	if nkey == s.me.Subject {
+		s.showInfo("You can not block yourself")
+		return
+	}
+	if on {
+		s.prefs.Blocked[nkey] = name
+	} else {
+		delete(s.prefs.Blocked, nkey)
+	}
+	if err := s.prefs.save(); err != nil {
+		s.showInfo("Could not save preferences: %v", err)
+		return
+	}
+	if on {
+		s.showInfo("Blocked %s", name)
+	} else {
+		s.showInfo("Unblocked %s", name)
+	}
+}
+
+// Assume lock is held. Muted channels do not show as unread.
+func (s *state) muteChannel(on bool, args []string) {
+	var ch string
+	if len(args) > 0 {
+		ch = strings.TrimPrefix(args[0], "#")
+	} else if s.cur != nil && s.cur.kind == channel {
+		ch = s.cur.name
+	}
+	if s.posts[ch] == nil {
+		s.showInfo("Usage: /mute [channel] | /unmute [channel]")
+		return
+	}
+	if on {
+		s.prefs.Muted[ch] = true
+		delete(s.unread, ch)
+		s.updateChannelList()
+	} else {
+		delete(s.prefs.Muted, ch)
+	}
+	if err := s.prefs.save(); err != nil {
+		s.showInfo("Could not save preferences: %v", err)
+		return
+	}
+	if on {
+		s.showInfo("Muted %s", ch)
+	} else {
+		s.showInfo("Unmuted %s", ch)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	userPrefix    = "@"
+	channelPrefix = "#"
+)
+
+// Commands we complete, see processCommand.
+var commandNames = []string{
+	"/block", "/diag", "/download", "/export", "/me", "/mod", "/more", "/mute", "/pin", "/pins",
+	"/reload", "/topic", "/unblock", "/unmute", "/unpin", "/upload",
+}
+
+// Lock should be held. Returns what tok could complete to, sorted.
+// Commands only complete at the start of the line.
+func (s *state) completions(tok string, first bool) []string {
+	var cands []string
+	switch {
+	case strings.HasPrefix(tok, userPrefix):
+		for name := range s.dms {
+			cands = append(cands, userPrefix+name)
+		}
+	case strings.HasPrefix(tok, channelPrefix):
+		for _, ch := range s.chans {
+			cands = append(cands, channelPrefix+ch)
+		}
+	case strings.HasPrefix(tok, cmdPrefix) && first:
+		cands = commandNames
+	}
+	var matches []string
+	for _, c := range cands {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(tok)) {
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// Lock should be held. Users can be given as name or @name.
+func (s *state) lookupUser(name string) *user {
+	return s.dms[strings.TrimPrefix(name, userPrefix)]
+}
+
+// completion is an ongoing Tab completion in the composer.
+type completion struct {
+	start   int
+	matches []string
+	next    int
+}
+
+// Completes the token before the cursor, or cycles through the
+// matches when called again. Returns false if there is nothing
+// to complete, so Tab can move the focus instead.
+func (c *composer) complete(fn func(tok string, first bool) []string) bool {
+	if c.comp == nil {
+		start := c.idx
+		for start > 0 && !isSpace(c.buf[start-1]) {
+			start--
+		}
+		if start == c.idx {
+			return false
+		}
+		matches := fn(string(c.buf[start:c.idx]), start == 0)
+		if len(matches) == 0 {
+			return false
+		}
+		c.comp = &completion{start: start, matches: matches}
+	}
+	m := c.comp.matches[c.comp.next]
+	if len(c.comp.matches) == 1 {
+		m += " "
+	}
+	c.comp.next = (c.comp.next + 1) % len(c.comp.matches)
+
+	tail := append([]rune(m), c.buf[c.idx:]...)
+	c.buf = append(c.buf[:c.comp.start], tail...)
+	c.idx = c.comp.start + len([]rune(m))
+	return true
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n'
+}
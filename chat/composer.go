@@ -0,0 +1,268 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image"
+	"unicode"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+const (
+	// Lines the composer grows to before it scrolls.
+	maxComposerLines = 6
+
+	// Sent messages we can recall with Up and Down.
+	maxInputHistory = 100
+)
+
+// composer is a multi-line input. Enter sends, Shift+Enter, Alt+Enter
+// or Ctrl+J add a new line since not all terminals report Shift.
+type composer struct {
+	tui.WidgetBase
+
+	buf []rune
+	idx int
+
+	history []string
+	hpos    int    // into history, len(history) when editing
+	draft   string // what we were writing before recalling
+
+	comp *completion
+
+	onSubmit func(*composer)
+}
+
+func newComposer() *composer {
+	c := &composer{}
+	c.SetSizePolicy(tui.Expanding, tui.Maximum)
+	return c
+}
+
+func (c *composer) OnSubmit(fn func(*composer)) {
+	c.onSubmit = fn
+}
+
+func (c *composer) Text() string {
+	return string(c.buf)
+}
+
+func (c *composer) SetText(text string) {
+	c.buf = []rune(text)
+	c.idx = len(c.buf)
+	c.comp = nil
+}
+
+// Remembers a sent message for recall.
+func (c *composer) addHistory(text string) {
+	if n := len(c.history); n == 0 || c.history[n-1] != text {
+		c.history = append(c.history, text)
+	}
+	if len(c.history) > maxInputHistory {
+		c.history = c.history[len(c.history)-maxInputHistory:]
+	}
+	c.hpos = len(c.history)
+	c.draft = ""
+}
+
+func (c *composer) recall(delta int) {
+	pos := c.hpos + delta
+	if pos < 0 || pos > len(c.history) {
+		return
+	}
+	if c.hpos == len(c.history) {
+		c.draft = c.Text()
+	}
+	c.hpos = pos
+	if pos == len(c.history) {
+		c.SetText(c.draft)
+	} else {
+		c.SetText(c.history[pos])
+	}
+}
+
+func (c *composer) insert(r rune) {
+	c.buf = append(c.buf, 0)
+	copy(c.buf[c.idx+1:], c.buf[c.idx:])
+	c.buf[c.idx] = r
+	c.idx++
+}
+
+// Deletes from start up to the cursor.
+func (c *composer) deleteTo(start int) {
+	c.buf = append(c.buf[:start], c.buf[c.idx:]...)
+	c.idx = start
+}
+
+func (c *composer) lineStart() int {
+	i := c.idx
+	for i > 0 && c.buf[i-1] != '\n' {
+		i--
+	}
+	return i
+}
+
+func (c *composer) lineEnd() int {
+	i := c.idx
+	for i < len(c.buf) && c.buf[i] != '\n' {
+		i++
+	}
+	return i
+}
+
+func (c *composer) wordStart() int {
+	i := c.idx
+	for i > 0 && unicode.IsSpace(c.buf[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(c.buf[i-1]) {
+		i--
+	}
+	return i
+}
+
+func (c *composer) OnKeyEvent(ev tui.KeyEvent) {
+	if !c.IsFocused() {
+		return
+	}
+	// Tab is handled by a keybinding, see complete.
+	if ev.Key == tui.KeyTab || ev.Key == tui.KeyBacktab {
+		return
+	}
+	c.comp = nil
+	if ev.Key == tui.KeyRune {
+		c.insert(ev.Rune)
+		return
+	}
+	switch ev.Key {
+	case tui.KeyEnter:
+		if ev.Modifiers&(tui.ModShift|tui.ModAlt) != 0 {
+			c.insert('\n')
+		} else if c.onSubmit != nil {
+			c.onSubmit(c)
+		}
+	case tui.KeyCtrlJ:
+		c.insert('\n')
+	case tui.KeyBackspace, tui.KeyBackspace2:
+		if c.idx > 0 {
+			c.idx--
+			c.buf = append(c.buf[:c.idx], c.buf[c.idx+1:]...)
+		}
+	case tui.KeyDelete, tui.KeyCtrlD:
+		if c.idx < len(c.buf) {
+			c.buf = append(c.buf[:c.idx], c.buf[c.idx+1:]...)
+		}
+	case tui.KeyLeft, tui.KeyCtrlB:
+		if c.idx > 0 {
+			c.idx--
+		}
+	case tui.KeyRight, tui.KeyCtrlF:
+		if c.idx < len(c.buf) {
+			c.idx++
+		}
+	case tui.KeyHome, tui.KeyCtrlA:
+		c.idx = c.lineStart()
+	case tui.KeyEnd, tui.KeyCtrlE:
+		c.idx = c.lineEnd()
+	case tui.KeyCtrlK:
+		end := c.lineEnd()
+		c.buf = append(c.buf[:c.idx], c.buf[end:]...)
+	case tui.KeyCtrlU:
+		c.deleteTo(c.lineStart())
+	case tui.KeyCtrlW:
+		c.deleteTo(c.wordStart())
+	case tui.KeyUp:
+		c.recall(-1)
+	case tui.KeyDown:
+		c.recall(1)
+	}
+}
+
+// Splits the text into screen lines of at most width runes,
+// and finds the cursor on them.
+func (c *composer) layout(width int) (lines []string, cursor image.Point) {
+	if width < 1 {
+		width = 1
+	}
+	var line []rune
+	for i, r := range c.buf {
+		if i == c.idx {
+			cursor = image.Pt(len(line), len(lines))
+		}
+		if r == '\n' {
+			lines = append(lines, string(line))
+			line = line[:0]
+			continue
+		}
+		if len(line) == width {
+			lines = append(lines, string(line))
+			line = line[:0]
+			if i == c.idx {
+				cursor = image.Pt(0, len(lines))
+			}
+		}
+		line = append(line, r)
+	}
+	if c.idx == len(c.buf) {
+		if len(line) == width {
+			lines = append(lines, string(line))
+			line = line[:0]
+		}
+		cursor = image.Pt(len(line), len(lines))
+	}
+	return append(lines, string(line)), cursor
+}
+
+func (c *composer) SizeHint() image.Point {
+	width := c.Size().X
+	if width == 0 {
+		width = 10
+	}
+	lines, _ := c.layout(width)
+	h := len(lines)
+	if h > maxComposerLines {
+		h = maxComposerLines
+	}
+	return image.Pt(width, h)
+}
+
+func (c *composer) MinSizeHint() image.Point {
+	return image.Pt(1, 1)
+}
+
+// Scrolls so the cursor stays in view.
+func (c *composer) Draw(p *tui.Painter) {
+	style := "entry"
+	if c.IsFocused() {
+		style += ".focused"
+	}
+	p.WithStyle(style, func(p *tui.Painter) {
+		size := c.Size()
+		lines, cursor := c.layout(size.X)
+		first := 0
+		if cursor.Y >= size.Y {
+			first = cursor.Y - size.Y + 1
+		}
+		for y := 0; y < size.Y; y++ {
+			p.FillRect(0, y, size.X, 1)
+			if first+y < len(lines) {
+				p.DrawText(0, y, lines[first+y])
+			}
+		}
+		if c.IsFocused() {
+			p.DrawCursor(cursor.X, cursor.Y-first)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/marcusolsson/tui-go"
+)
+
+const (
+	configFile = "config"
+
+	defaultTimeFormat = "15:04"
+)
+
+// config is read from ~/.config/natschat/config, in TOML:
+//
+//	server = "nats://localhost:4222"
+//	creds = "~/my.creds"
+//	channel = "General"
+//	timestamp = "15:04"
+//
+//	[keys]
+//	quit = "Ctrl+Q"
+//
+//	[[workspace]]
+//	name = "Team"
+//	audience = "TEAM"
+//	creds = "~/team.creds"
+//
+//	[theme]
+//	code = "green"
+//	url = "cyan, underline"
+//
+// Command line flags override it.
+type config struct {
+	path string
+
+	Server    string            `toml:"server"`
+	Creds     string            `toml:"creds"`
+	Channel   string            `toml:"channel"`
+	Timestamp string            `toml:"timestamp"`
+	Keys      map[string]string `toml:"keys"`  // action -> key
+	Theme     map[string]string `toml:"theme"` // element -> colors and attributes
+
+	// Without any, the server and creds above are the one workspace.
+	Workspaces []*workspace `toml:"workspace"`
+}
+
+// Actions we can bind, and their default keys.
+var defaultKeys = map[string]string{
+	"quit":      "Ctrl+C",
+	"complete":  "TAB", // moves the focus when there is nothing to complete
+	"focus":     "Backtab",
+	"page_up":   "PgUp",
+	"page_down": "PgDn",
+	"home":      "Home", // with an empty input line
+	"end":       "End",
+	"workspace": "Ctrl+N", // the next one, with more than one
+}
+
+// Theme elements and the styles they set.
+var themeStyles = map[string]string{
+	"bold":     styleBold,
+	"italic":   styleItalic,
+	"code":     styleCode,
+	"url":      styleURL,
+	"action":   styleAction,
+	"note":     styleNote,
+	"selected": "list.item.selected",
+}
+
+var colors = map[string]tui.Color{
+	"default": tui.ColorDefault,
+	"black":   tui.ColorBlack,
+	"white":   tui.ColorWhite,
+	"red":     tui.ColorRed,
+	"green":   tui.ColorGreen,
+	"blue":    tui.ColorBlue,
+	"cyan":    tui.ColorCyan,
+	"magenta": tui.ColorMagenta,
+	"yellow":  tui.ColorYellow,
+}
+
+// A missing file gives the defaults.
+func loadConfig(path string) (*config, error) {
+	c := &config{path: path}
+	if _, err := toml.DecodeFile(path, c); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not load config %q: %v", path, err)
+	}
+	for action := range c.Keys {
+		if _, ok := defaultKeys[action]; !ok {
+			return nil, fmt.Errorf("unknown key action %q in %q", action, path)
+		}
+	}
+	if _, err := c.theme(); err != nil {
+		return nil, fmt.Errorf("bad theme in %q: %v", path, err)
+	}
+	if c.Timestamp == "" {
+		c.Timestamp = defaultTimeFormat
+	}
+	c.Creds = expandHome(c.Creds)
+	auds := make(map[string]bool)
+	for _, ws := range c.Workspaces {
+		ws.setDefaults(c.Server)
+		if ws.Creds == "" {
+			return nil, fmt.Errorf("workspace %q in %q has no creds", ws.Name, path)
+		}
+		if auds[ws.Audience] {
+			return nil, fmt.Errorf("workspace audience %q twice in %q", ws.Audience, path)
+		}
+		auds[ws.Audience] = true
+	}
+	return c, nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+func (c *config) key(action string) string {
+	if k := c.Keys[action]; k != "" {
+		return k
+	}
+	return defaultKeys[action]
+}
+
+// Our default theme with the elements the config sets.
+func (c *config) theme() (*tui.Theme, error) {
+	t := newTheme()
+	for elem, spec := range c.Theme {
+		name, ok := themeStyles[elem]
+		if !ok {
+			return nil, fmt.Errorf("unknown element %q", elem)
+		}
+		style, err := parseStyle(spec)
+		if err != nil {
+			return nil, err
+		}
+		t.SetStyle(name, style)
+	}
+	return t, nil
+}
+
+// Parses e.g. "red, bold", "white, bg:blue" or "fg:default, bg:default".
+func parseStyle(spec string) (tui.Style, error) {
+	var style tui.Style
+	for _, f := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		f = strings.ToLower(f)
+		switch {
+		case f == "bold":
+			style.Bold = tui.DecorationOn
+		case f == "underline":
+			style.Underline = tui.DecorationOn
+		case f == "reverse":
+			style.Reverse = tui.DecorationOn
+		case strings.HasPrefix(f, "bg:") && isColor(f[3:]):
+			style.Bg = colors[f[3:]]
+		case strings.HasPrefix(f, "fg:") && isColor(f[3:]):
+			style.Fg = colors[f[3:]]
+		case isColor(f):
+			style.Fg = colors[f]
+		default:
+			return style, fmt.Errorf("unknown color or attribute %q", f)
+		}
+	}
+	return style, nil
+}
+
+// The default color is the zero Color, so it can not be told
+// apart from an unknown name by value.
+func isColor(name string) bool {
+	_, ok := colors[name]
+	return ok
+}
+
+// Sets up our keybindings, again after a reload. They act on the
+// workspace being shown.
+func (a *app) setKeybindings() {
+	c := a.config
+	a.ui.ClearKeybindings()
+	a.ui.SetKeybinding(c.key("quit"), func() { a.quit(nil) })
+	if len(a.spaces) > 1 {
+		a.ui.SetKeybinding(c.key("workspace"), a.next)
+	}
+
+	// Navigation, Tab completes in the input when it can.
+	a.ui.SetKeybinding(c.key("complete"), func() {
+		s := a.active()
+		s.Lock()
+		defer s.Unlock()
+		if s.input.IsFocused() && s.input.complete(s.completions) {
+			return
+		}
+		s.switchFocus()
+	})
+	a.ui.SetKeybinding(c.key("focus"), func() {
+		s := a.active()
+		s.Lock()
+		defer s.Unlock()
+		s.switchFocus()
+	})
+
+	// Scrollback, Home and End move the cursor while typing.
+	a.ui.SetKeybinding(c.key("page_up"), func() { a.active().msgs.page(true) })
+	a.ui.SetKeybinding(c.key("page_down"), func() { a.active().msgs.page(false) })
+	a.ui.SetKeybinding(c.key("home"), func() {
+		if s := a.active(); s.input.Text() == "" {
+			s.msgs.home()
+		}
+	})
+	a.ui.SetKeybinding(c.key("end"), func() {
+		if s := a.active(); s.input.Text() == "" {
+			s.msgs.end()
+		}
+	})
+}
+
+// Assume the lock of s, the active workspace, is held. Called from
+// the UI goroutine. Servers and creds are only used when we start,
+// the others pick up the changes when shown.
+func (a *app) reloadConfig(s *state) {
+	c, err := loadConfig(a.config.path)
+	if err != nil {
+		s.showInfo("%v", err)
+		return
+	}
+	theme, _ := c.theme()
+	old := a.config
+	a.config = c
+	a.ui.SetTheme(theme)
+	a.setKeybindings()
+	s.setPostsDisplay(s.cur)
+	s.showInfo("Reloaded %s", c.path)
+	if c.Server != old.Server || c.Creds != old.Creds || len(c.Workspaces) != len(old.Workspaces) {
+		s.showInfo("Restart to use a different server, creds or workspaces")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+const (
+	// Lines we keep, and how many the pane shows.
+	maxDiagLines  = 100
+	diagPaneLines = 4
+)
+
+// diagnostics collects rejected claims and other errors. It has
+// its own lock since errors are logged with and without the state
+// lock held.
+type diagnostics struct {
+	sync.Mutex
+	lines  []string
+	hidden bool // by the user
+	shown  bool
+
+	// UI Items
+	label *tui.Label
+	box   *tui.Box
+}
+
+// Returns true if the pane needs updating.
+func (d *diagnostics) add(line string) bool {
+	d.Lock()
+	defer d.Unlock()
+	d.lines = append(d.lines, line)
+	if len(d.lines) > maxDiagLines {
+		d.lines = d.lines[len(d.lines)-maxDiagLines:]
+	}
+	return d.label != nil && !d.hidden
+}
+
+func (d *diagnostics) tail(n int) string {
+	if len(d.lines) < n {
+		n = len(d.lines)
+	}
+	return strings.Join(d.lines[len(d.lines)-n:], "\n")
+}
+
+// Called in the UI goroutine. The pane shows up below
+// the messages once there is something to show.
+func (s *state) showDiagnostics() {
+	d := s.diag
+	d.Lock()
+	defer d.Unlock()
+	d.label.SetText(d.tail(diagPaneLines))
+	if !d.shown && !d.hidden && len(d.lines) > 0 {
+		s.chat.Insert(1, d.box)
+		d.shown = true
+	}
+}
+
+// Assume lock is held. Toggles the pane with /diag, and
+// shows everything we kept in the message pane with /diag all.
+func (s *state) toggleDiagnostics(args []string) {
+	d := s.diag
+	if len(args) > 0 && args[0] == "all" {
+		d.Lock()
+		lines := append([]string(nil), d.lines...)
+		d.Unlock()
+		for _, l := range lines {
+			s.showInfo("%s", l)
+		}
+		return
+	}
+
+	d.Lock()
+	d.hidden = !d.hidden
+	hide := d.hidden && d.shown
+	if hide {
+		s.chat.Remove(1)
+		d.shown = false
+	}
+	d.Unlock()
+	if !hide {
+		s.showDiagnostics()
+	}
+}
@@ -0,0 +1,610 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Transcript formats.
+const (
+	exportJSON     = "json"
+	exportMarkdown = "md"
+	exportText     = "txt"
+
+	exportTimeFormat = "2006-01-02 15:04:05"
+)
+
+// Claims in any text, e.g. an export in any format or the history
+// store. They all start with the same header.
+var claimRe = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+
+// transcript is an exported channel or DM conversation. With the
+// signed post JWTs and the user JWTs of who sent them it can be
+// verified, and imported, by anyone who trusts the account.
+type transcript struct {
+	Workspace    string        `json:"workspace"`
+	Conversation string        `json:"conversation"` // #channel or @name
+	Exported     time.Time     `json:"exported"`
+	Posts        []*exportPost `json:"posts"`
+	Users        []string      `json:"users,omitempty"`
+}
+
+type exportPost struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	From string    `json:"from"` // nkey
+	Name string    `json:"name"`
+	To   string    `json:"to"` // channel or nkey
+	Msg  string    `json:"msg"`
+	JWT  string    `json:"jwt,omitempty"`
+}
+
+// With ujwts, the user JWTs of the posters, the transcript has
+// all the JWTs.
+func newTranscript(ws *workspace, label string, posts []*postClaim, ujwts map[string]string) *transcript {
+	t := &transcript{Workspace: ws.Audience, Conversation: label, Exported: time.Now()}
+	users := make(map[string]bool)
+	for _, p := range posts {
+		msg, _ := p.Data["msg"].(string)
+		ep := &exportPost{
+			ID:   p.ID,
+			Time: time.Unix(p.IssuedAt, 0),
+			From: p.Issuer,
+			Name: p.Name,
+			To:   p.Subject,
+			Msg:  msg,
+		}
+		if ujwts != nil {
+			ep.JWT = p.raw
+			if ujwt := ujwts[p.Issuer]; ujwt != "" && !users[p.Issuer] {
+				users[p.Issuer] = true
+				t.Users = append(t.Users, ujwt)
+			}
+		}
+		t.Posts = append(t.Posts, ep)
+	}
+	return t
+}
+
+func (t *transcript) fileName(format string) string {
+	name := strings.TrimLeft(t.Conversation, "#@")
+	return name + "-" + t.Exported.Format("20060102-1504") + "." + format
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case exportJSON, exportMarkdown, exportText:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, use %s, %s or %s", format, exportJSON, exportMarkdown, exportText)
+}
+
+func (t *transcript) save(file, format string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = t.write(f, format)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (t *transcript) write(w io.Writer, format string) error {
+	switch format {
+	case exportJSON:
+		out, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	case exportMarkdown:
+		return t.writeMarkdown(w)
+	case exportText:
+		return t.writeText(w)
+	}
+	return checkFormat(format)
+}
+
+// Posts are a list, the JWTs are in comments so they do not show.
+func (t *transcript) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s in %s\n\n", t.Conversation, t.Workspace)
+	fmt.Fprintf(&b, "Exported %s, %d posts.\n\n", t.Exported.Format(exportTimeFormat+" MST"), len(t.Posts))
+	for _, p := range t.Posts {
+		when := p.Time.Format(exportTimeFormat)
+		lines := strings.Split(p.Msg, "\n")
+		if strings.HasPrefix(p.Msg, actionPrefix) {
+			fmt.Fprintf(&b, "- %s _%s %s_\n", when, p.Name, strings.TrimPrefix(lines[0], actionPrefix))
+		} else {
+			fmt.Fprintf(&b, "- %s **%s**: %s\n", when, p.Name, lines[0])
+		}
+		for _, l := range lines[1:] {
+			fmt.Fprintf(&b, "  %s\n", l)
+		}
+		if p.JWT != "" {
+			fmt.Fprintf(&b, "  <!-- %s -->\n", p.JWT)
+		}
+	}
+	if len(t.Users) > 0 {
+		fmt.Fprintf(&b, "\n<!-- Users, to verify the posts:\n%s\n-->\n", strings.Join(t.Users, "\n"))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Like an IRC log.
+func (t *transcript) writeText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s in %s, exported %s, %d posts.\n\n", t.Conversation, t.Workspace,
+		t.Exported.Format(exportTimeFormat+" MST"), len(t.Posts))
+	for _, p := range t.Posts {
+		when := p.Time.Format(exportTimeFormat)
+		lines := strings.Split(p.Msg, "\n")
+		if strings.HasPrefix(p.Msg, actionPrefix) {
+			fmt.Fprintf(&b, "[%s] * %s %s\n", when, p.Name, strings.TrimPrefix(lines[0], actionPrefix))
+		} else {
+			fmt.Fprintf(&b, "[%s] <%s> %s\n", when, p.Name, lines[0])
+		}
+		for _, l := range lines[1:] {
+			fmt.Fprintf(&b, "    %s\n", l)
+		}
+		if p.JWT != "" {
+			fmt.Fprintf(&b, "    jwt %s\n", p.JWT)
+		}
+	}
+	if len(t.Users) > 0 {
+		b.WriteString("\nUsers, to verify the posts:\n")
+		for _, u := range t.Users {
+			fmt.Fprintf(&b, "    %s\n", u)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Lock should be held. What we have of a conversation, on disk
+// and in memory.
+func (s *state) convPosts(conv string, r *postRing) ([]*postClaim, error) {
+	posts, err := s.history.all(conv)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, p := range posts {
+		seen[p.raw] = true
+	}
+	for _, p := range r.slice() {
+		if !seen[p.raw] && p.raw != "" {
+			posts = append(posts, p)
+		}
+	}
+	return posts, nil
+}
+
+const exportUsage = "Usage: /export [json|md|txt] [jwts] [file]"
+
+// Assume lock is held. Exports the current conversation, with
+// the JWTs when asked for. The user JWTs we do not have yet are
+// asked for first.
+func (s *state) export(args []string) {
+	conv := s.curConv()
+	if conv == "" {
+		s.showInfo("Nothing to export")
+		return
+	}
+	format, withJWTs, file := exportMarkdown, false, ""
+	for _, a := range args {
+		switch {
+		case a == "jwts":
+			withJWTs = true
+		case checkFormat(a) == nil:
+			format = a
+		case file == "":
+			file = a
+		default:
+			s.showInfo(exportUsage)
+			return
+		}
+	}
+
+	var r *postRing
+	label := "#" + s.cur.name
+	if s.cur.kind == channel {
+		r = s.posts[s.cur.name]
+	} else {
+		u := s.dms[s.cur.name]
+		r, label = u.posts, "@"+u.name
+	}
+	posts, err := s.convPosts(conv, r)
+	if err != nil {
+		s.showInfo("Could not export: %v", err)
+		return
+	}
+	if !withJWTs {
+		s.saveTranscript(newTranscript(s.ws, label, posts, nil), file, format)
+		return
+	}
+
+	missing := make(map[string]bool)
+	for _, p := range posts {
+		if s.ujwts[p.Issuer] == "" {
+			missing[p.Issuer] = true
+		}
+	}
+	go func() {
+		found := make(map[string]string)
+		for nkey := range missing {
+			s.Lock()
+			subj := idsReqSubj
+			if r := s.remoteUsers[nkey]; r != nil {
+				subj = r.subject(idsReqSubj)
+			}
+			s.Unlock()
+			if ujwt, err := requestUserJWT(s.nc, subj, nkey); err == nil {
+				found[nkey] = ujwt
+			}
+		}
+		s.ui.Update(func() {
+			s.Lock()
+			defer s.Unlock()
+			ujwts := make(map[string]string)
+			for nkey, ujwt := range s.ujwts {
+				ujwts[nkey] = ujwt
+			}
+			for nkey, ujwt := range found {
+				ujwts[nkey] = ujwt
+			}
+			s.saveTranscript(newTranscript(s.ws, label, posts, ujwts), file, format)
+		})
+	}()
+}
+
+// Lock should be held.
+func (s *state) saveTranscript(t *transcript, file, format string) {
+	if file == "" {
+		file = t.fileName(format)
+	}
+	if err := t.save(expandHome(file), format); err != nil {
+		s.showInfo("Could not export: %v", err)
+		return
+	}
+	s.showInfo("Exported %d posts to %s", len(t.Posts), file)
+}
+
+// Asks chat-access for the user JWT of nkey, as it issued it.
+func requestUserJWT(nc *nats.Conn, subj, nkey string) (string, error) {
+	resp, err := nc.Request(subj, []byte(nkey), idsWait)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(string(resp.Data), "-ERR") {
+		return "", errors.New(string(resp.Data))
+	}
+	return string(resp.Data), nil
+}
+
+func exportCmdUsage() {
+	log.Printf("Usage: chat export [-s server] [-aud workspace] [-creds file] [-format json|md|txt] [-jwts] [-o file] channel|@user\n")
+}
+
+// Exports a conversation from the history store. With -jwts the
+// user JWTs are asked for from chat-access, with our creds.
+func exportMain(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var server = fs.String("s", "localhost", "NATS System")
+	var aud = fs.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var creds = fs.String("creds", "", "User Credentials File, to get user JWTs with -jwts")
+	var format = fs.String("format", exportMarkdown, "Format, json, md or txt")
+	var withJWTs = fs.Bool("jwts", false, "Include the signed JWTs, so the transcript can be verified")
+	var out = fs.String("o", "", "Output File, instead of stdout")
+	fs.Usage = func() {
+		exportCmdUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := checkFormat(*format); err != nil {
+		log.Fatal(err)
+	}
+	if *withJWTs && *creds == "" {
+		log.Fatalf("-jwts needs -creds to get the user JWTs")
+	}
+	ws := &workspace{Server: *server, Audience: *aud, Creds: *creds}
+	ws.setDefaults(*server)
+	h := newHistory(filepath.Join(configDir(), historyDir, ws.Audience))
+
+	target := fs.Arg(0)
+	var conv, label string
+	if strings.HasPrefix(target, "@") {
+		conv = h.findDM(target[1:])
+		label = target
+	} else if ch := chatChannel("#" + strings.TrimPrefix(target, "#")); ch != "" {
+		conv, label = channelConv(ch), "#"+ch
+	}
+	if conv == "" {
+		log.Fatalf("No conversation %q in the %s history", target, ws.Audience)
+	}
+	posts, err := h.all(conv)
+	if err != nil {
+		log.Fatalf("Could not load history: %v", err)
+	}
+
+	var ujwts map[string]string
+	if *withJWTs {
+		ujwts = fetchUserJWTs(ws, posts)
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.OpenFile(*out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	t := newTranscript(ws, label, posts, ujwts)
+	if err := t.write(w, *format); err != nil {
+		log.Fatalf("Could not export: %v", err)
+	}
+	if *out != "" {
+		log.Printf("Exported %d posts to %s", len(t.Posts), *out)
+	}
+}
+
+// Connects as the user of the workspace creds to ask for the user
+// JWTs of those who sent posts.
+func fetchUserJWTs(ws *workspace, posts []*postClaim) map[string]string {
+	me, _, ujwt := loadUser(ws.Creds)
+	nc, err := nats.Connect(ws.Server, nats.Name(ws.Audience+" NATS Chat Export"), nats.UserCredentials(ws.Creds))
+	if err != nil {
+		log.Fatalf("Could not connect: %v", err)
+	}
+	defer nc.Close()
+	ujwts := map[string]string{me.Subject: ujwt}
+	for _, p := range posts {
+		if _, ok := ujwts[p.Issuer]; ok {
+			continue
+		}
+		u, err := requestUserJWT(nc, idsReqSubj, p.Issuer)
+		if err != nil {
+			log.Printf("No user JWT for %s (%s): %v", p.Name, p.Issuer, err)
+		}
+		ujwts[p.Issuer] = u
+	}
+	return ujwts
+}
+
+// The DM conversation with the user of that display name, or nkey.
+func (h *history) findDM(name string) string {
+	if nkeys.IsValidPublicUserKey(name) {
+		return directConv(name)
+	}
+	files, _ := filepath.Glob(h.file(directConv("*")))
+	for _, f := range files {
+		conv := strings.TrimSuffix(filepath.Base(f), ".jwt")
+		nkey := strings.TrimPrefix(conv, directConv(""))
+		posts, _ := h.all(conv)
+		for _, p := range posts {
+			if p.Issuer == nkey && displayName(p.Name) == displayName(name) {
+				return conv
+			}
+		}
+	}
+	return ""
+}
+
+// archive is what we take from an export, or any text with JWTs
+// in it: posts, and the user JWTs of who sent them.
+type archive struct {
+	posts []*postClaim
+	users map[string]*jwt.UserClaims
+}
+
+// Claims that do not decode, e.g. with a bad signature, are errors.
+func readArchive(data []byte) (*archive, []error) {
+	a := &archive{users: make(map[string]*jwt.UserClaims)}
+	var errs []error
+	seen := make(map[string]bool)
+	for _, raw := range claimRe.FindAllString(string(data), -1) {
+		c, err := jwt.DecodeGeneric(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bad claim: %v", err))
+			continue
+		}
+		switch c.Type {
+		case jwt.UserClaim:
+			uc, err := jwt.DecodeUserClaims(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad user JWT: %v", err))
+				continue
+			}
+			// Keep the most recent one, e.g. after a reclaim.
+			if cur := a.users[uc.Subject]; cur == nil || cur.IssuedAt < uc.IssuedAt {
+				a.users[uc.Subject] = uc
+			}
+		case "chat-post", "chat-dm":
+			if !seen[raw] {
+				seen[raw] = true
+				a.posts = append(a.posts, &postClaim{GenericClaims: c, raw: raw})
+			}
+		}
+	}
+	sort.SliceStable(a.posts, func(i, j int) bool { return a.posts[i].IssuedAt < a.posts[j].IssuedAt })
+	return a, errs
+}
+
+// verify checks an archived post. Its signature was checked when
+// it was decoded. It needs to be for the workspace, with validity
+// times we would have accepted when it was sent, and from a user
+// of an account we trust, valid at the time.
+func (a *archive) verify(ws *workspace, t *trust, p *postClaim) error {
+	if err := checkArchivedClaim(ws, p); err != nil {
+		return err
+	}
+	return a.verifyIssuer(t, p)
+}
+
+func checkArchivedClaim(ws *workspace, p *postClaim) error {
+	vr := jwt.CreateValidationResults()
+	p.Validate(vr)
+	if vr.IsBlocking(false) {
+		return fmt.Errorf("blocking issues: %v", vr.Errors())
+	}
+	if p.Audience != ws.Audience {
+		return fmt.Errorf("wrong audience %q", p.Audience)
+	}
+	switch {
+	case p.Expires == 0:
+		return errors.New("claim has no expiration")
+	case p.Expires-p.IssuedAt > int64(maxClaimTTL/time.Second):
+		return errors.New("claim is valid for too long")
+	case p.NotBefore > p.Expires || p.IssuedAt > p.Expires:
+		return errors.New("claim expired before it was valid")
+	case p.IssuedAt > time.Now().Add(clockSkew).Unix():
+		return errors.New("claim is issued in the future")
+	}
+	return nil
+}
+
+func (a *archive) verifyIssuer(t *trust, p *postClaim) error {
+	uc := a.users[p.Issuer]
+	if uc == nil {
+		return fmt.Errorf("no user JWT for %q", p.Issuer)
+	}
+	return t.verifyArchivedUser(uc, p.IssuedAt)
+}
+
+func importUsage() {
+	log.Printf("Usage: chat import [-aud workspace] [-acc account-jwt] [-creds file] file...\n")
+}
+
+// Loads exported transcripts into the history store, once each
+// post is verified again. They need to have been exported with
+// their JWTs. DMs need our creds, to know who the other side is.
+func importMain(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var aud = fs.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var accFile = fs.String("acc", "", "Account JWT File, to trust its signing keys")
+	var creds = fs.String("creds", "", "User Credentials File, to trust its account and import our DMs")
+	fs.Usage = func() {
+		importUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || (*accFile == "" && *creds == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	ws := &workspace{Audience: *aud, Creds: *creds, Account: *accFile}
+	ws.setDefaults("")
+	var me *jwt.UserClaims
+	var t *trust
+	if ws.Creds != "" {
+		me, _, _ = loadUser(ws.Creds)
+		t = newTrust(me, ws.Account)
+	} else {
+		t = accountTrust(loadAccount(ws.Account))
+	}
+	h := newHistory(filepath.Join(configDir(), historyDir, ws.Audience))
+
+	for _, file := range fs.Args() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a, errs := readArchive(data)
+		for _, err := range errs {
+			log.Printf("%s: %v", file, err)
+		}
+		if len(a.posts) == 0 {
+			log.Printf("%s: no posts, was it exported with the JWTs?", file)
+			continue
+		}
+
+		convs := make(map[string][]*postClaim)
+		var order []string
+		rejected := 0
+		for _, p := range a.posts {
+			conv, err := importConv(me, p)
+			if err == nil {
+				err = a.verify(ws, t, p)
+			}
+			if err != nil {
+				log.Printf("%s: rejected post %s from %q: %v", file, p.ID, p.Name, err)
+				rejected++
+				continue
+			}
+			if convs[conv] == nil {
+				order = append(order, conv)
+			}
+			convs[conv] = append(convs[conv], p)
+		}
+		for _, conv := range order {
+			added, err := h.merge(conv, convs[conv])
+			if err != nil {
+				log.Fatalf("Could not save history: %v", err)
+			}
+			log.Printf("%s: imported %d posts into %s, %d were there already",
+				file, added, conv, len(convs[conv])-added)
+		}
+		if rejected > 0 {
+			log.Printf("%s: rejected %d posts", file, rejected)
+		}
+	}
+}
+
+// Where a post goes in the history store. Channels need to be
+// ours, DMs to or from us.
+func importConv(me *jwt.UserClaims, p *postClaim) (string, error) {
+	if p.Type == "chat-post" {
+		if ch := chatChannel("#" + p.Subject); ch == p.Subject {
+			return channelConv(ch), nil
+		}
+		return "", fmt.Errorf("no channel %q", p.Subject)
+	}
+	switch {
+	case me == nil:
+		return "", errors.New("DMs need -creds")
+	case !nkeys.IsValidPublicUserKey(p.Subject):
+		return "", fmt.Errorf("bad DM subject %q", p.Subject)
+	case p.Issuer == me.Subject:
+		return directConv(p.Subject), nil
+	case p.Subject == me.Subject:
+		return directConv(p.Issuer), nil
+	}
+	return "", errors.New("DM is not to or from us")
+}
@@ -0,0 +1,105 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
+)
+
+type testUser struct {
+	uc   *jwt.UserClaims
+	ujwt string
+	kp   nkeys.KeyPair
+}
+
+func newTestUser(t *testing.T, akp nkeys.KeyPair, name string) *testUser {
+	t.Helper()
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	uc := jwt.NewUserClaims(pub)
+	uc.Name = name
+	ujwt, err := uc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Could not sign user: %v", err)
+	}
+	if uc, err = jwt.DecodeUserClaims(ujwt); err != nil {
+		t.Fatalf("Could not decode user: %v", err)
+	}
+	return &testUser{uc, ujwt, kp}
+}
+
+// A DM sent from the TUI, exported with its JWTs, imports into the
+// DM conversation on both ends.
+func TestExportImportDM(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	acc := jwt.NewAccountClaims(apub)
+	alice := newTestUser(t, akp, "alice")
+	bob := newTestUser(t, akp, "bob")
+
+	ws := &workspace{Audience: defaultAudience}
+	s := &state{
+		me:    alice.uc,
+		skp:   alice.kp,
+		name:  "alice",
+		ws:    ws,
+		dms:   make(map[string]*user),
+		users: make(map[string]*user),
+
+		outbox: &outbox{},
+	}
+	s.addNewUser("bob", bob.uc.Subject)
+	s.cur = &selection{name: "bob", kind: direct}
+
+	p := s.newPost("hello bob")
+	raw, err := p.Encode(s.skp)
+	if err != nil {
+		t.Fatalf("Could not sign post: %v", err)
+	}
+	p.raw = raw
+
+	var out bytes.Buffer
+	ujwts := map[string]string{alice.uc.Subject: alice.ujwt}
+	if err := newTranscript(ws, "@bob", []*postClaim{p}, ujwts).write(&out, exportJSON); err != nil {
+		t.Fatalf("Could not export: %v", err)
+	}
+
+	a, errs := readArchive(out.Bytes())
+	if len(errs) > 0 || len(a.posts) != 1 {
+		t.Fatalf("Expected one post, got %d: %v", len(a.posts), errs)
+	}
+	tr := accountTrust(acc)
+	for _, c := range []struct {
+		me   *testUser
+		conv string
+	}{
+		{alice, directConv(bob.uc.Subject)},
+		{bob, directConv(alice.uc.Subject)},
+	} {
+		conv, err := importConv(c.me.uc, a.posts[0])
+		if err != nil {
+			t.Fatalf("Could not import as %s: %v", c.me.uc.Name, err)
+		}
+		if conv != c.conv {
+			t.Fatalf("Expected %s to import into %q, got %q", c.me.uc.Name, c.conv, conv)
+		}
+		if err := a.verify(ws, tr, a.posts[0]); err != nil {
+			t.Fatalf("Expected the post to verify: %v", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Accounts that share a workspace export its posts, and the user
+// JWTs their chat-access issued, and import those of each other
+// under the other's public key. See chat-access federate. Should
+// match chat-access versions.
+const fedPrefix = "fed.%s."
+
+// Width of remote account keys when they have no name.
+const shortKeyLen = 8
+
+// remote is another account we share the posts of a workspace with.
+// Its users are verified against its signing keys, not ours.
+type remote struct {
+	account string
+	name    string
+	trust   *trust
+}
+
+func loadRemotes(files []string) []*remote {
+	var remotes []*remote
+	for _, f := range files {
+		acc := loadAccount(f)
+		r := &remote{account: acc.Subject, name: acc.Name, trust: accountTrust(acc)}
+		if r.name == "" {
+			r.name = acc.Subject[:shortKeyLen]
+		}
+		remotes = append(remotes, r)
+	}
+	return remotes
+}
+
+// Where subj of the remote account shows up for us.
+func (r *remote) subject(subj string) string {
+	return fmt.Sprintf(fedPrefix, r.account) + subj
+}
+
+// Lock should be held. Users of remote accounts are shown as
+// name@account.
+func (s *state) remoteName(nkey, name string) string {
+	if r := s.remoteUsers[nkey]; r != nil {
+		return name + "@" + r.name
+	}
+	return name
+}
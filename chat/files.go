@@ -0,0 +1,417 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// Files are too big for posts. The post sharing one has its hash
+// and the hash chain of its chunks, which the uploader sends as
+// signed claims on files.<id> when asked on files.<id>.get, for
+// as long as it runs.
+const (
+	filesPub   = "files.%s"
+	fileGetPub = "files.%s.get"
+
+	maxFileSize = 256 * 1024
+
+	// Chunks are at least this big, but for the last one, so a
+	// file has at most maxChunks.
+	minChunkSize = 64
+	maxChunks    = maxFileSize / minChunkSize
+
+	// A download fails when no chunk comes for this long.
+	fileWait = 10 * time.Second
+
+	// Room for the chunk index and hashes when sizing chunks.
+	chunkSlack = 16
+)
+
+// fileInfo is what a file-share post says about the file.
+type fileInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Hash   string `json:"hash"`  // SHA-256 of the file
+	Chain  string `json:"chain"` // of the chunks, see link
+	Chunks int    `json:"chunks"`
+}
+
+// sharedFile is a file we uploaded, kept to send to those who ask.
+type sharedFile struct {
+	info   *fileInfo
+	chunks [][]byte
+	prevs  []string // chain before each chunk
+	sub    *nats.Subscription
+
+	sending, again bool
+}
+
+// Chunks are hash linked, each link is the SHA-256 of the one
+// before and the chunk. The first comes after all zeros.
+func link(prev []byte, chunk []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+// Files are told apart by content and uploader.
+func newSharedFile(nkey, name string, data []byte, chunkSize int) *sharedFile {
+	sum := sha256.Sum256(data)
+	id := sha256.Sum256(append([]byte(nkey), sum[:]...))
+	f := &sharedFile{info: &fileInfo{
+		ID:   base32.StdEncoding.EncodeToString(id[:])[:20],
+		Name: name,
+		Size: len(data),
+		Hash: hex.EncodeToString(sum[:]),
+	}}
+	chain := make([]byte, sha256.Size)
+	for len(data) > 0 || f.chunks == nil {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		f.prevs = append(f.prevs, hex.EncodeToString(chain))
+		f.chunks = append(f.chunks, data[:n])
+		chain = link(chain, data[:n])
+		data = data[n:]
+	}
+	f.info.Chain = hex.EncodeToString(chain)
+	f.info.Chunks = len(f.chunks)
+	return f
+}
+
+func (s *state) newChunk(id string, i int, prev string, data []byte) *jwt.GenericClaims {
+	c := jwt.NewGenericClaims(id)
+	c.Audience = s.ws.Audience
+	setValidity(&c.ClaimsData, postTTL)
+	c.Type = jwt.ClaimType("chat-file-chunk")
+	c.Data["i"] = i
+	c.Data["prev"] = prev
+	c.Data["data"] = base64.StdEncoding.EncodeToString(data)
+	return c
+}
+
+// The most file bytes a signed chunk can hold in our max payload.
+func (s *state) chunkSize() int {
+	max := s.maxPayload() - chunkSlack
+	prev := strings.Repeat("0", 2*sha256.Size)
+	fits := func(n int) bool {
+		cjwt, _ := s.newChunk(strings.Repeat("A", 20), maxFileSize, prev, make([]byte, n)).Encode(s.skp)
+		return len(cjwt) <= max
+	}
+	lo, hi := 1, max
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// The file a post shares, if it does. What it says is what we
+// allocate for when downloading, so it needs to be within limits.
+func postFile(p *postClaim) *fileInfo {
+	if p.Data["file"] == nil {
+		return nil
+	}
+	data, _ := json.Marshal(p.Data["file"])
+	var info fileInfo
+	if json.Unmarshal(data, &info) != nil || info.ID == "" {
+		return nil
+	}
+	if info.Size < 0 || info.Size > maxFileSize || info.Chunks <= 0 || info.Chunks > maxChunks ||
+		info.Chunks > info.Size/minChunkSize+1 {
+		return nil
+	}
+	return &info
+}
+
+func fileSize(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// Assume lock is held. Shares a file in the current channel.
+func (s *state) upload(args []string) {
+	if len(args) != 1 {
+		s.showInfo("Usage: /upload <path>")
+		return
+	}
+	if s.cur == nil || s.cur.kind != channel {
+		s.showInfo("Files can only be shared in channels, anyone in the workspace can fetch them")
+		return
+	}
+	if !s.nc.IsConnected() {
+		s.showInfo("Not connected, share it once we are")
+		return
+	}
+	path := expandHome(args[0])
+	st, err := os.Stat(path)
+	if err == nil && st.Size() > maxFileSize {
+		err = fmt.Errorf("it is over the %s limit", fileSize(maxFileSize))
+	}
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		s.showInfo("Could not share %s: %v", args[0], err)
+		return
+	}
+
+	size := s.chunkSize()
+	if size < minChunkSize {
+		s.showInfo("Could not share %s: our max payload is too small for files", args[0])
+		return
+	}
+	f := newSharedFile(s.me.Subject, filepath.Base(path), data, size)
+	info := f.info
+	p := s.newPost(fmt.Sprintf("shared %s, %s, /download %s", info.Name, fileSize(info.Size), info.ID))
+	p.Data["file"] = info
+	if !s.limiter.allow(time.Now()) {
+		s.showInfo("Slow down, the file was not shared")
+		return
+	}
+	pjwt, err := p.Encode(s.skp)
+	if err == nil && len(pjwt) > s.maxPayload() {
+		err = errors.New("the file name is too long")
+	}
+	if err != nil {
+		s.showInfo("Could not share %s: %v", args[0], err)
+		return
+	}
+	if s.shared[info.ID] == nil {
+		f.sub, err = s.nc.Subscribe(s.ws.subject(fileGetPub, info.ID), func(m *nats.Msg) {
+			s.sendFile(info.ID)
+		})
+		if err != nil {
+			s.showInfo("Could not share %s: %v", args[0], err)
+			return
+		}
+		s.shared[info.ID] = f
+	}
+	p.raw = pjwt
+	s.registerPost(p.ID, p.Expires)
+	s.nc.Publish(s.postSubject(), []byte(pjwt))
+	s.addPostToCurrent(p)
+	s.msgs.appendRow(s.postEntry(p))
+}
+
+// Sends the chunks of a file we share, signed now. Asks while we
+// send get one more round, so those who came late get it all.
+func (s *state) sendFile(id string) {
+	s.Lock()
+	f := s.shared[id]
+	if f == nil || f.sending {
+		if f != nil {
+			f.again = true
+		}
+		s.Unlock()
+		return
+	}
+	f.sending = true
+	s.Unlock()
+
+	subj := s.ws.subject(filesPub, id)
+	for {
+		for i, chunk := range f.chunks {
+			cjwt, err := s.newChunk(id, i, f.prevs[i], chunk).Encode(s.skp)
+			if err != nil {
+				break
+			}
+			s.nc.Publish(subj, []byte(cjwt))
+		}
+		s.nc.Flush()
+
+		s.Lock()
+		again := f.again
+		f.again, f.sending = false, again
+		s.Unlock()
+		if !again {
+			return
+		}
+	}
+}
+
+// Assume lock is held. Fetches a file shared in a post we have.
+func (s *state) download(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		s.showInfo("Usage: /download <id> [path]")
+		return
+	}
+	p, info := s.findFile(args[0])
+	if info == nil {
+		s.showInfo("No file %q shared in a post we have", args[0])
+		return
+	}
+	if s.downloads[info.ID] {
+		s.showInfo("Already downloading %s", info.Name)
+		return
+	}
+	path := filepath.Base(info.Name)
+	if len(args) > 1 {
+		path = expandHome(args[1])
+		if st, err := os.Stat(path); err == nil && st.IsDir() {
+			path = filepath.Join(path, filepath.Base(info.Name))
+		}
+	}
+	s.downloads[info.ID] = true
+	s.showInfo("Downloading %s, %s from %s", info.Name, fileSize(info.Size), s.localUserName(p))
+	go s.fetchFile(p.Issuer, info, path)
+}
+
+// Lock should be held. Newest post first.
+func (s *state) findFile(id string) (*postClaim, *fileInfo) {
+	for _, r := range s.posts {
+		posts := r.slice()
+		for i := len(posts) - 1; i >= 0; i-- {
+			if info := postFile(posts[i]); info != nil && info.ID == id {
+				return posts[i], info
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *state) fetchFile(issuer string, info *fileInfo, path string) {
+	data, err := s.receiveFile(issuer, info)
+	if err == nil {
+		path, err = saveFile(path, data)
+	}
+	s.ui.Update(func() {
+		s.Lock()
+		defer s.Unlock()
+		delete(s.downloads, info.ID)
+		if err != nil {
+			s.showInfo("Could not download %s: %v", info.Name, err)
+			return
+		}
+		s.showInfo("Saved %s to %s, it matches the hash %s shared", info.Name, path, info.Hash[:12])
+	})
+}
+
+// Asks the uploader for the chunks, checks each is theirs and the
+// chain and hash of the whole against the post.
+func (s *state) receiveFile(issuer string, info *fileInfo) ([]byte, error) {
+	chunks := make([][]byte, info.Chunks)
+	prevs := make([]string, info.Chunks)
+	got := make(chan int, info.Chunks)
+	received := 0 // bytes, handled on one goroutine
+
+	sub, err := s.nc.Subscribe(s.ws.subject(filesPub, info.ID), func(m *nats.Msg) {
+		c, err := jwt.DecodeGeneric(string(m.Data))
+		if err != nil || s.checkClaim(c) != nil {
+			return
+		}
+		if c.Issuer != issuer || c.Subject != info.ID || c.Type != "chat-file-chunk" {
+			return
+		}
+		i, ok := c.Data["i"].(float64)
+		prev, _ := c.Data["prev"].(string)
+		data, err := base64.StdEncoding.DecodeString(fmt.Sprint(c.Data["data"]))
+		if !ok || err != nil || int(i) < 0 || int(i) >= info.Chunks || chunks[int(i)] != nil ||
+			received+len(data) > info.Size {
+			return
+		}
+		received += len(data)
+		chunks[int(i)], prevs[int(i)] = data, prev
+		got <- int(i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := s.nc.Publish(s.ws.subject(fileGetPub, info.ID), nil); err != nil {
+		return nil, err
+	}
+
+	for n := 0; n < info.Chunks; n++ {
+		select {
+		case <-got:
+		case <-time.After(fileWait):
+			return nil, fmt.Errorf("got %d of %d chunks, is the uploader still here?", n, info.Chunks)
+		}
+	}
+	sub.Unsubscribe()
+
+	chain := make([]byte, sha256.Size)
+	var file bytes.Buffer
+	for i, chunk := range chunks {
+		if prevs[i] != hex.EncodeToString(chain) {
+			return nil, fmt.Errorf("chunk %d does not link to the one before", i)
+		}
+		chain = link(chain, chunk)
+		file.Write(chunk)
+	}
+	sum := sha256.Sum256(file.Bytes())
+	switch {
+	case hex.EncodeToString(chain) != info.Chain:
+		return nil, errors.New("chunks do not match the chain shared")
+	case hex.EncodeToString(sum[:]) != info.Hash:
+		return nil, errors.New("file does not match the hash shared")
+	case file.Len() != info.Size:
+		return nil, errors.New("file is not the size shared")
+	}
+	return file.Bytes(), nil
+}
+
+// Never overwrites, name.1.ext and so on are used instead.
+func saveFile(path string, data []byte) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; ; i++ {
+		p := path
+		if i > 0 {
+			p = fmt.Sprintf("%s.%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return p, err
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// verifier checks the claims a gateway, chat web or chat ircd,
+// passes on to one of its users. Gateways have no UI to hold
+// messages in, so they wait for user JWTs instead.
+type verifier struct {
+	sync.Mutex
+	ws    *workspace
+	trust *trust
+	ids   map[string]*jwt.UserClaims
+	dd    *replayCache
+}
+
+// Only users of the account we serve, when we were given it.
+func newVerifier(ws *workspace, me *jwt.UserClaims, acc *jwt.AccountClaims) (*verifier, error) {
+	v := &verifier{
+		ws:    ws,
+		trust: userTrust(me),
+		ids:   map[string]*jwt.UserClaims{me.Subject: me},
+		dd:    newReplayCache(""),
+	}
+	if acc != nil {
+		if acc.Subject != v.trust.account {
+			return nil, errors.New("user is not from this workspace's account")
+		}
+		v.trust.addAccount(acc)
+		if err := v.trust.verifyUser(me); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Returns the claim in data if it is valid, from a user we can
+// verify and not one we have seen before.
+func (v *verifier) check(nc *nats.Conn, data []byte) *jwt.GenericClaims {
+	c, err := jwt.DecodeGeneric(string(data))
+	if err != nil || v.ws.checkClaim(c) != nil {
+		return nil
+	}
+	if err := v.verify(nc, c.Issuer); err != nil {
+		return nil
+	}
+	v.Lock()
+	defer v.Unlock()
+	if v.dd.check(c.ID, c.Issuer, c.Expires) {
+		return nil
+	}
+	return c
+}
+
+// Asks chat-access for the user JWT of nkey, once. We run on the
+// subscription's goroutine, so waiting keeps posts in order.
+func (v *verifier) verify(nc *nats.Conn, nkey string) error {
+	v.Lock()
+	known := v.ids[nkey] != nil
+	v.Unlock()
+	if known {
+		return nil
+	}
+	resp, err := nc.Request(idsReqSubj, []byte(nkey), idsWait)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(resp.Data), "-ERR") {
+		return errors.New(string(resp.Data))
+	}
+	uc, err := jwt.DecodeUserClaims(string(resp.Data))
+	if err != nil {
+		return err
+	}
+	if uc.Subject != nkey {
+		return fmt.Errorf("got user JWT for %q", uc.Subject)
+	}
+	if err := v.trust.verifyUser(uc); err != nil {
+		return err
+	}
+	v.Lock()
+	v.ids[nkey] = uc
+	v.Unlock()
+	return nil
+}
+
+// A chat-post to a channel or a chat-dm to an nkey, from a
+// gateway user.
+func (ws *workspace) newMsg(kind, to, name, msg string) *jwt.GenericClaims {
+	p := jwt.NewGenericClaims(to)
+	p.Name = name
+	p.Audience = ws.Audience
+	setValidity(&p.ClaimsData, postTTL)
+	p.Data["msg"] = msg
+	p.Type = jwt.ClaimType(kind)
+	return p
+}
+
+// The max payload of a user, from their JWT if it sets one.
+func payloadLimit(me *jwt.UserClaims, nc *nats.Conn) int {
+	if max := me.Limits.Payload; max > 0 {
+		return int(max)
+	}
+	return int(nc.MaxPayload())
+}
@@ -3,8 +3,10 @@ module github.com/connecteverything/oscon2019/chat
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/gorilla/websocket v1.4.2
 	github.com/marcusolsson/tui-go v0.4.0
-	github.com/nats-io/jwt v0.2.10
+	github.com/nats-io/jwt v1.2.2
 	github.com/nats-io/nats.go v1.8.1
-	github.com/nats-io/nkeys v0.1.0
+	github.com/nats-io/nkeys v0.2.0
 )
@@ -0,0 +1,374 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/jwt"
+)
+
+const (
+	historyDir = "history"
+
+	// Default posts kept in memory per channel or DM.
+	defaultMaxPosts = 1000
+)
+
+// postRing keeps the most recent posts of a channel or DM.
+type postRing struct {
+	buf   []*postClaim
+	start int
+	n     int
+}
+
+func newPostRing(size int) *postRing {
+	if size <= 0 {
+		size = defaultMaxPosts
+	}
+	return &postRing{buf: make([]*postClaim, size)}
+}
+
+// push adds a post and returns the one evicted, if any.
+func (r *postRing) push(p *postClaim) *postClaim {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = p
+		r.n++
+		return nil
+	}
+	evicted := r.buf[r.start]
+	r.buf[r.start] = p
+	r.start = (r.start + 1) % len(r.buf)
+	return evicted
+}
+
+func (r *postRing) len() int {
+	return r.n
+}
+
+// at returns the ith oldest post.
+func (r *postRing) at(i int) *postClaim {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+// slice returns the posts, oldest first.
+func (r *postRing) slice() []*postClaim {
+	posts := make([]*postClaim, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		posts = append(posts, r.at(i))
+	}
+	return posts
+}
+
+// remove drops the post with the given ID.
+func (r *postRing) remove(id string) bool {
+	posts := r.slice()
+	for i, p := range posts {
+		if p.ID == id {
+			posts = append(posts[:i], posts[i+1:]...)
+			for j := range r.buf {
+				r.buf[j] = nil
+			}
+			copy(r.buf, posts)
+			r.start, r.n = 0, len(posts)
+			return true
+		}
+	}
+	return false
+}
+
+// history keeps posts evicted from memory on disk, one signed
+// post JWT per line and file per channel or DM. Where each line
+// starts is indexed, so paging back with /more only reads the
+// posts it shows. Like the rest of state it is guarded by its lock.
+type history struct {
+	dir string
+	idx map[string]*historyIndex
+}
+
+// historyIndex has the offsets of the lines in a history file. Only
+// what was appended since is read to bring it up to date.
+type historyIndex struct {
+	file os.FileInfo // that was indexed
+	size int64       // indexed so far, up to the end of a line
+	offs []int64     // where each non-empty line starts
+}
+
+func newHistory(dir string) *history {
+	return &history{dir: dir, idx: make(map[string]*historyIndex)}
+}
+
+// Conversations are keyed by channel name or the user's nkey,
+// never by display names.
+func channelConv(name string) string {
+	return "posts." + name
+}
+
+func directConv(nkey string) string {
+	return "dms." + nkey
+}
+
+func (h *history) file(conv string) string {
+	return filepath.Join(h.dir, conv+".jwt")
+}
+
+func (h *history) append(conv string, p *postClaim) error {
+	if p.raw == "" {
+		return nil
+	}
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.file(conv), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, p.raw)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// load returns up to n posts older than the newest skip ones,
+// oldest first. Signatures are checked, expiration is not.
+func (h *history) load(conv string, skip, n int) ([]*postClaim, error) {
+	f, err := os.Open(h.file(conv))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hi, err := h.index(conv, f)
+	if err != nil {
+		return nil, err
+	}
+	end := len(hi.offs) - skip
+	if end <= 0 {
+		return nil, nil
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	limit := hi.size
+	if end < len(hi.offs) {
+		limit = hi.offs[end]
+	}
+	buf := make([]byte, limit-hi.offs[start])
+	if _, err := f.ReadAt(buf, hi.offs[start]); err != nil {
+		return nil, err
+	}
+	posts := make([]*postClaim, 0, end-start)
+	for _, l := range strings.Split(string(buf), "\n") {
+		if l = strings.TrimSuffix(l, "\r"); l == "" {
+			continue
+		}
+		c, err := jwt.DecodeGeneric(l)
+		if err != nil {
+			continue
+		}
+		posts = append(posts, &postClaim{GenericClaims: c, raw: l})
+	}
+	return posts, nil
+}
+
+// index brings the index of conv up to date with its open file.
+// A file merge replaced, here or by chat import, or that shrank
+// was rewritten, and is indexed again.
+func (h *history) index(conv string, f *os.File) (*historyIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hi := h.idx[conv]
+	if hi == nil || !os.SameFile(hi.file, fi) || fi.Size() < hi.size {
+		hi = &historyIndex{file: fi}
+		h.idx[conv] = hi
+	}
+	if fi.Size() == hi.size {
+		return hi, nil
+	}
+	if _, err := f.Seek(hi.size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		l, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Lines are only indexed once complete.
+			return hi, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimRight(l, "\r\n")) > 0 {
+			hi.offs = append(hi.offs, hi.size)
+		}
+		hi.size += int64(len(l))
+	}
+}
+
+// all returns the posts we have on disk for conv, oldest first.
+func (h *history) all(conv string) ([]*postClaim, error) {
+	return h.load(conv, 0, h.count(conv))
+}
+
+// merge adds posts we do not have yet to conv, keeping it in the
+// order they were sent. Returns how many were new.
+func (h *history) merge(conv string, posts []*postClaim) (int, error) {
+	have, err := h.all(conv)
+	if err != nil {
+		return 0, err
+	}
+	// Not by ID, posts sent the same second can share one.
+	seen := make(map[string]bool)
+	for _, p := range have {
+		seen[p.raw] = true
+	}
+	added := 0
+	for _, p := range posts {
+		if !seen[p.raw] && p.raw != "" {
+			seen[p.raw] = true
+			have = append(have, p)
+			added++
+		}
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	sort.SliceStable(have, func(i, j int) bool { return have[i].IssuedAt < have[j].IssuedAt })
+
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return 0, err
+	}
+	var b strings.Builder
+	for _, p := range have {
+		fmt.Fprintln(&b, p.raw)
+	}
+	tmp := h.file(conv) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return 0, err
+	}
+	// Rewritten, so lines may have moved.
+	delete(h.idx, conv)
+	return added, os.Rename(tmp, h.file(conv))
+}
+
+// count returns how many posts we have on disk for conv.
+func (h *history) count(conv string) int {
+	f, err := os.Open(h.file(conv))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	hi, err := h.index(conv, f)
+	if err != nil {
+		return 0
+	}
+	return len(hi.offs)
+}
+
+// Lock should be held. Adds a post to a ring, offloading
+// the one evicted to the history store.
+func (s *state) storePost(conv string, r *postRing, p *postClaim) {
+	if evicted := r.push(p); evicted != nil {
+		if err := s.history.append(conv, evicted); err != nil {
+			s.logErr("-ERR Could not save history: %v", err)
+		}
+	}
+}
+
+// Lock should be held. Moves the posts still in memory to the
+// history store when we quit, so it has all we have seen.
+func (s *state) saveHistory() {
+	for ch, r := range s.posts {
+		s.saveRing(channelConv(ch), r)
+	}
+	for _, u := range s.users {
+		s.saveRing(directConv(u.nkey), u.posts)
+	}
+}
+
+// Posts still in the outbox are shown again when we restart.
+func (s *state) saveRing(conv string, r *postRing) {
+	for _, p := range r.slice() {
+		if p.status == postPending {
+			continue
+		}
+		if err := s.history.append(conv, p); err != nil {
+			log.Printf("Could not save history: %v", err)
+			return
+		}
+	}
+}
+
+// Lock should be held. Shows n more posts from the history
+// store above the ones in memory.
+func (s *state) showOlder(n int) {
+	if !s.loadOlder(n) {
+		s.showInfo("No more history")
+	}
+}
+
+// Lock should be held. Returns false if there is nothing more.
+func (s *state) loadOlder(n int) bool {
+	conv := s.curConv()
+	if conv == "" {
+		return false
+	}
+	total := s.history.count(conv)
+	if n <= 0 || s.older >= total {
+		return false
+	}
+	if s.older += n; s.older > total {
+		s.older = total
+	}
+	s.setPostsDisplay(s.cur)
+	return true
+}
+
+// Called in the UI goroutine when the view is scrolled to
+// the first post we show.
+func (s *state) loadOlderOnTop() {
+	s.Lock()
+	s.loadOlder(defaultMore)
+	s.Unlock()
+}
+
+// Lock should be held.
+func (s *state) curConv() string {
+	if s.cur == nil {
+		return ""
+	}
+	if s.cur.kind == channel {
+		return channelConv(s.cur.name)
+	}
+	if u := s.dms[s.cur.name]; u != nil {
+		return directConv(u.nkey)
+	}
+	return ""
+}
@@ -0,0 +1,233 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// Posts only reference the issuer's nkey, the user JWT would not fit
+// in our max payload. We ask chat-access for the user JWTs it issued.
+const (
+	idsReqSubj = "chat.req.ids"
+	idsWait    = 5 * time.Second
+
+	// Max messages held per issuer while we wait for their user JWT.
+	maxPending = 32
+)
+
+// trust holds the keys that user JWTs need to be signed by.
+type trust struct {
+	account string
+	keys    map[string]bool
+	acc     *jwt.AccountClaims
+}
+
+// By default we trust the account of our own creds and the key that
+// signed them. With the account JWT we trust all its signing keys
+// and also honor its revocations.
+func newTrust(me *jwt.UserClaims, accFile string) *trust {
+	t := userTrust(me)
+	if accFile == "" {
+		return t
+	}
+	acc := loadAccount(accFile)
+	if acc.Subject != t.account {
+		log.Fatalf("Account %q does not match our credentials", acc.Subject)
+	}
+	t.addAccount(acc)
+	return t
+}
+
+// Trusts the account of the user and the key that signed it.
+func userTrust(me *jwt.UserClaims) *trust {
+	t := &trust{account: me.IssuerAccount, keys: make(map[string]bool)}
+	if t.account == "" {
+		t.account = me.Issuer
+	}
+	t.keys[t.account] = true
+	t.keys[me.Issuer] = true
+	return t
+}
+
+// Trusts only the account, when we have no creds of our own.
+func accountTrust(acc *jwt.AccountClaims) *trust {
+	t := &trust{account: acc.Subject, keys: make(map[string]bool)}
+	t.addAccount(acc)
+	return t
+}
+
+// Trusts the account and all its signing keys, and honors its
+// revocations.
+func (t *trust) addAccount(acc *jwt.AccountClaims) {
+	t.keys[acc.Subject] = true
+	for _, sk := range acc.SigningKeys {
+		t.keys[sk] = true
+	}
+	t.acc = acc
+}
+
+func loadAccount(accFile string) *jwt.AccountClaims {
+	contents, err := ioutil.ReadFile(accFile)
+	if err != nil {
+		log.Fatalf("Could not load account file: %v", err)
+	}
+	acc, err := jwt.DecodeAccountClaims(strings.TrimSpace(string(contents)))
+	if err != nil {
+		log.Fatalf("Could not decode account: %v", err)
+	}
+	return acc
+}
+
+// verifyUser checks that a user JWT chains to our account.
+func (t *trust) verifyUser(uc *jwt.UserClaims) error {
+	vr := jwt.CreateValidationResults()
+	uc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return fmt.Errorf("invalid user: %v", vr.Errors())
+	}
+	return t.checkIssuer(uc)
+}
+
+// verifyArchivedUser is verifyUser for the issuer of an archived
+// post. Their user JWT may have expired since, it only needs to
+// have been valid when the post was sent.
+func (t *trust) verifyArchivedUser(uc *jwt.UserClaims, sent int64) error {
+	vr := jwt.CreateValidationResults()
+	uc.Validate(vr)
+	if vr.IsBlocking(false) {
+		return fmt.Errorf("invalid user: %v", vr.Errors())
+	}
+	if uc.Expires > 0 && sent > uc.Expires {
+		return fmt.Errorf("user %q had expired when the post was sent", uc.Name)
+	}
+	return t.checkIssuer(uc)
+}
+
+func (t *trust) checkIssuer(uc *jwt.UserClaims) error {
+	if !t.keys[uc.Issuer] {
+		return fmt.Errorf("user %q signed by untrusted key %q", uc.Name, uc.Issuer)
+	}
+	if uc.Issuer != t.account && uc.IssuerAccount != t.account {
+		return fmt.Errorf("user %q not issued for account %q", uc.Name, t.account)
+	}
+	if t.acc != nil && t.acc.IsClaimRevoked(uc) {
+		return fmt.Errorf("user %q has been revoked", uc.Name)
+	}
+	return nil
+}
+
+// checkClaim applies the checks common to all chat claims, which
+// need to be for our workspace.
+func (s *state) checkClaim(c *jwt.GenericClaims) error {
+	return s.ws.checkClaim(c)
+}
+
+func (ws *workspace) checkClaim(c *jwt.GenericClaims) error {
+	vr := jwt.CreateValidationResults()
+	c.Validate(vr)
+	// We do our own time checks to allow for clock skew.
+	if vr.IsBlocking(false) {
+		return fmt.Errorf("blocking issues: %v", vr.Errors())
+	}
+	if err := checkTimes(&c.ClaimsData); err != nil {
+		return err
+	}
+	if c.Audience != ws.Audience {
+		return fmt.Errorf("wrong audience %q", c.Audience)
+	}
+	return nil
+}
+
+// Lock should be held. Holds a message until we have verified
+// the issuer, and asks for their user JWT. Users of a remote
+// account are asked for from its chat-access.
+func (s *state) awaitIdentity(nkey string, r *remote, m *nats.Msg, cb nats.MsgHandler) {
+	pending := s.pending[nkey]
+	if len(pending) >= maxPending {
+		return
+	}
+	if len(pending) == 0 {
+		go s.requestIdentity(nkey, r)
+	}
+	s.pending[nkey] = append(pending, pendingMsg{m, cb})
+}
+
+type pendingMsg struct {
+	m  *nats.Msg
+	cb nats.MsgHandler
+}
+
+// Asks chat-access for the user JWT of nkey. Messages waiting
+// on a user we can not verify are dropped.
+func (s *state) requestIdentity(nkey string, r *remote) {
+	subj := idsReqSubj
+	if r != nil {
+		subj = r.subject(idsReqSubj)
+	}
+	resp, err := s.nc.Request(subj, []byte(nkey), idsWait)
+	if err == nil {
+		err = s.addIdentity(string(resp.Data), r)
+	}
+	if err != nil {
+		s.Lock()
+		delete(s.pending, nkey)
+		s.logErr("-ERR Could not verify %s: %v", nkey, err)
+		s.Unlock()
+	}
+}
+
+// Verifies a user JWT, against the remote account if the user
+// is from one. Once verified we process any messages that were
+// waiting on it.
+func (s *state) addIdentity(ujwt string, r *remote) error {
+	uc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		return fmt.Errorf("bad user JWT %q", ujwt)
+	}
+	t := s.trust
+	if r != nil {
+		t = r.trust
+	}
+	if err := t.verifyUser(uc); err != nil {
+		return err
+	}
+
+	s.Lock()
+	// Keep the most recent one, e.g. after a reclaim.
+	if cur := s.ids[uc.Subject]; cur != nil && cur.IssuedAt > uc.IssuedAt {
+		s.Unlock()
+		return nil
+	}
+	s.ids[uc.Subject] = uc
+	s.ujwts[uc.Subject] = ujwt
+	if r != nil {
+		s.remoteUsers[uc.Subject] = r
+	}
+	pending := s.pending[uc.Subject]
+	delete(s.pending, uc.Subject)
+	s.Unlock()
+
+	for _, pm := range pending {
+		pm.cb(pm.m)
+	}
+	return nil
+}
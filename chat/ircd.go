@@ -0,0 +1,735 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultIRCAddr = "localhost:6667"
+	ircServerName  = "chat-ircd"
+
+	// How long a client has to send NICK and USER.
+	ircRegisterWait = 30 * time.Second
+
+	// Clients send at most 512 bytes a line, some a bit more.
+	ircMaxLine = 4096
+
+	// Nicks per RPL_NAMREPLY line.
+	ircNamesPerLine = 20
+
+	ctcpAction = "\x01ACTION "
+)
+
+// IRC numerics we reply with.
+const (
+	rplWelcome       = "001"
+	rplYourHost      = "002"
+	rplCreated       = "003"
+	rplMyInfo        = "004"
+	rplISupport      = "005"
+	rplUModeIs       = "221"
+	rplEndOfWho      = "315"
+	rplChannelModeIs = "324"
+	rplNoTopic       = "331"
+	rplWhoReply      = "352"
+	rplNamReply      = "353"
+	rplEndOfNames    = "366"
+	rplEndOfBanList  = "368"
+	errNoSuchNick    = "401"
+	errNoSuchChannel = "403"
+	errCannotSend    = "404"
+	errUnknownCmd    = "421"
+	errNoMotd        = "422"
+	errNoNickChange  = "447"
+	errNotOnChannel  = "442"
+	errNotRegistered = "451"
+	errNeedMoreParam = "461"
+	errPasswdMismtch = "464"
+)
+
+func ircdUsage() {
+	log.Printf("Usage: chat ircd [-s server] [-addr address] [-public] [-aud workspace] [-acc account-jwt]\n")
+	log.Printf("       chat ircd -pass creds-file\n")
+}
+
+// Serves IRC clients, with a NATS connection per client as the
+// user of the creds it gives as its password. Channels are our
+// channels, nicks are the display names of users online.
+func ircdMain(args []string) {
+	fs := flag.NewFlagSet("ircd", flag.ExitOnError)
+	var server = fs.String("s", "localhost", "NATS System")
+	var addr = fs.String("addr", defaultIRCAddr, "IRC Listen Address")
+	var public = fs.Bool("public", false, "Allow listening on other than loopback, passwords go in the clear")
+	var aud = fs.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var accFile = fs.String("acc", "", "Account JWT File, to trust its signing keys")
+	var pass = fs.String("pass", "", "Credentials File to print the IRC password of")
+	fs.Usage = func() {
+		ircdUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *pass != "" {
+		p, err := ircPassword(expandHome(*pass))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(p)
+		return
+	}
+
+	ws := &workspace{Server: *server, Audience: *aud}
+	ws.setDefaults(*server)
+	srv := &ircServer{ws: ws, created: time.Now()}
+	if *accFile != "" {
+		srv.acc = loadAccount(*accFile)
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Passwords are creds, only local clients should see them.
+	if tcp, ok := l.Addr().(*net.TCPAddr); !ok || !tcp.IP.IsLoopback() {
+		if !*public {
+			log.Fatalf("Not listening on %s, it is not a loopback address, see -public", l.Addr())
+		}
+		log.Printf("Warning: not on loopback, creds and posts go over the network in the clear")
+	}
+	log.SetFlags(log.LstdFlags)
+	log.Printf("Serving %s chat to IRC clients on %s", ws.Audience, l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go srv.serve(conn)
+	}
+}
+
+type ircServer struct {
+	ws      *workspace
+	acc     *jwt.AccountClaims
+	created time.Time
+}
+
+// ircSession bridges one IRC client to NATS.
+type ircSession struct {
+	sync.Mutex
+	srv  *ircServer
+	conn net.Conn
+	nc   *nats.Conn
+
+	me   *jwt.UserClaims
+	ujwt string
+	skp  nkeys.KeyPair
+	name string
+	nick string
+
+	v       *verifier
+	limiter *tokenBucket
+	done    chan struct{}
+
+	// Chat channels the client joined, and who we have seen.
+	joined map[string]bool
+	users  map[string]*ircUser
+	nicks  map[string]string // lower case nick to nkey
+}
+
+// ircUser is a chat user as IRC clients see them. They are on
+// all channels while their chat-online claims have not expired.
+type ircUser struct {
+	nkey    string
+	nick    string
+	name    string
+	online  bool
+	expires int64
+}
+
+func (srv *ircServer) serve(conn net.Conn) {
+	defer conn.Close()
+	sess := &ircSession{
+		srv:    srv,
+		conn:   conn,
+		done:   make(chan struct{}),
+		joined: make(map[string]bool),
+		users:  make(map[string]*ircUser),
+		nicks:  make(map[string]string),
+	}
+	defer close(sess.done)
+
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(make([]byte, 512), ircMaxLine)
+	if err := sess.register(lines); err != nil {
+		sess.send(ircServerName, "ERROR", "Closing link: "+err.Error())
+		return
+	}
+	if err := sess.connect(); err != nil {
+		sess.send(ircServerName, "ERROR", "Closing link: "+err.Error())
+		return
+	}
+	defer sess.nc.Close()
+	go sess.sendOnlineStatus()
+
+	for lines.Scan() {
+		cmd, params := parseIRC(lines.Text())
+		if cmd == "QUIT" {
+			sess.send(ircServerName, "ERROR", "Closing link: quit")
+			return
+		}
+		sess.handle(cmd, params)
+	}
+}
+
+// Splits a line into its command and parameters, the last of
+// which may have spaces when it starts with a colon.
+func parseIRC(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			line = line[i+1:]
+		} else {
+			line = ""
+		}
+	}
+	var params []string
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			params = append(params, line)
+			break
+		}
+		params = append(params, line[:i])
+		line = line[i+1:]
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// Line breaks and NULs end IRC lines, or confuse clients, so no
+// parameter can have them.
+var ircUnsafe = strings.NewReplacer("\r", " ", "\n", " ", "\x00", "")
+
+// Sends a line, the last parameter may have spaces.
+func (sess *ircSession) send(prefix, cmd string, params ...string) {
+	var b strings.Builder
+	b.WriteString(":" + ircUnsafe.Replace(prefix) + " " + cmd)
+	for i, p := range params {
+		p = ircUnsafe.Replace(p)
+		if i == len(params)-1 {
+			b.WriteString(" :" + p)
+		} else {
+			b.WriteString(" " + p)
+		}
+	}
+	b.WriteString("\r\n")
+	sess.conn.Write([]byte(b.String()))
+}
+
+// Sends a numeric reply, which are addressed to our nick.
+func (sess *ircSession) reply(numeric string, params ...string) {
+	nick := sess.nick
+	if nick == "" {
+		nick = "*"
+	}
+	sess.send(ircServerName, numeric, append([]string{nick}, params...)...)
+}
+
+// Waits for PASS, NICK and USER. The password is the user JWT and
+// seed of chat creds, see ircPassword, as we sign posts for them.
+func (sess *ircSession) register(lines *bufio.Scanner) error {
+	var pass, nick string
+	var user bool
+	sess.conn.SetReadDeadline(time.Now().Add(ircRegisterWait))
+	for !user || nick == "" {
+		if !lines.Scan() {
+			return errors.New("expected NICK and USER")
+		}
+		cmd, params := parseIRC(lines.Text())
+		switch cmd {
+		case "PASS", "NICK", "USER":
+			if len(params) == 0 {
+				sess.reply(errNeedMoreParam, cmd, "Not enough parameters")
+				continue
+			}
+		}
+		switch cmd {
+		case "CAP":
+			// No capabilities, so clients end negotiation.
+			if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+				sess.send(ircServerName, "CAP", "*", "LS", "")
+			}
+		case "PASS":
+			pass = params[0]
+		case "NICK":
+			nick = params[0]
+		case "USER":
+			user = true
+		case "PING":
+			sess.send(ircServerName, "PONG", ircServerName, strings.Join(params, " "))
+		case "QUIT":
+			return errors.New("quit")
+		case "":
+		default:
+			sess.reply(errNotRegistered, "You have not registered")
+		}
+	}
+	sess.conn.SetReadDeadline(time.Time{})
+
+	if pass == "" {
+		sess.reply(errPasswdMismtch, "Password needed, see chat ircd -pass")
+		return errors.New("no creds")
+	}
+	if err := sess.login(pass); err != nil {
+		sess.reply(errPasswdMismtch, err.Error())
+		return err
+	}
+
+	// Our nick is our chat name, whatever the client asked for.
+	sess.nick = sess.addUser(sess.me.Subject, sess.name).nick
+	if nick != sess.nick {
+		sess.send(nick, "NICK", sess.nick)
+	}
+	return nil
+}
+
+// IRC passwords are one line, so the user JWT and the seed of the
+// creds file are joined with a colon, neither has one.
+func ircPassword(credsFile string) (string, error) {
+	contents, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		return "", err
+	}
+	items := nscDecoratedRe.FindAllSubmatch(contents, -1)
+	if len(items) != 2 {
+		return "", errors.New("Expected user JWT and seed!")
+	}
+	return string(items[0][1]) + ":" + string(items[1][1]), nil
+}
+
+func (sess *ircSession) login(pass string) error {
+	i := strings.IndexByte(pass, ':')
+	if i < 0 {
+		return errors.New("password is not a user JWT and seed, see chat ircd -pass")
+	}
+	var err error
+	if sess.me, sess.skp, sess.ujwt, err = decodeCreds([]byte(pass[:i]), []byte(pass[i+1:])); err != nil {
+		return err
+	}
+	if sess.v, err = newVerifier(sess.srv.ws, sess.me, sess.srv.acc); err != nil {
+		return err
+	}
+	sess.name = displayName(sess.me.Name)
+	sess.limiter = newTokenBucket(rateHint(sess.me.Tags))
+	return nil
+}
+
+func (sess *ircSession) connect() error {
+	ws := sess.srv.ws
+	opts := []nats.Option{
+		nats.Name(ws.Audience + " NATS IRC Chat"),
+		nats.UserJWT(func() (string, error) { return sess.ujwt, nil }, sess.skp.Sign),
+		nats.NoEcho(),
+		nats.MaxReconnects(-1),
+		nats.ClosedHandler(func(nc *nats.Conn) { sess.conn.Close() }),
+	}
+	nc, err := nats.Connect(ws.Server, opts...)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+	sess.nc = nc
+
+	sess.Lock()
+	sess.reply(rplWelcome, fmt.Sprintf("Welcome to the %s chat, %s", ws.Audience, sess.nick))
+	sess.reply(rplYourHost, fmt.Sprintf("Your host is %s, bridging to %s", ircServerName, ws.Server))
+	sess.reply(rplCreated, "This server was created "+sess.srv.created.Format(time.RFC1123))
+	sess.send(ircServerName, rplMyInfo, sess.nick, ircServerName, "0", "o", "nt")
+	sess.reply(rplISupport, "CHANTYPES=#", "NICKLEN="+fmt.Sprint(maxNameLen+5), "are supported by this server")
+	sess.reply(errNoMotd, "Channels are "+strings.Join(ircChannels(), " "))
+	sess.Unlock()
+
+	nc.Subscribe(ws.subject(postsSub), sess.receive)
+	nc.Subscribe(ws.subject(dmsPub, sess.me.Subject), sess.receive)
+	nc.Subscribe(ws.subject(onlineSub), sess.receive)
+	return nil
+}
+
+// Announces us as online, and has those who go offline leave.
+func (sess *ircSession) sendOnlineStatus() {
+	t := time.NewTicker(onlineInterval / 2)
+	defer t.Stop()
+	first := true
+	for {
+		sess.publishOnlineStatus(first)
+		first = false
+		select {
+		case <-t.C:
+		case <-sess.done:
+			return
+		}
+		sess.expireUsers()
+	}
+}
+
+func (sess *ircSession) publishOnlineStatus(first bool) {
+	ws := sess.srv.ws
+	online := ws.newOnline(sess.me.Subject, sess.name, first)
+	if ojwt, err := online.Encode(sess.skp); err == nil {
+		sess.nc.Publish(ws.subject(onlineSub), []byte(ojwt))
+	}
+}
+
+func (sess *ircSession) expireUsers() {
+	sess.Lock()
+	defer sess.Unlock()
+	now := time.Now().Unix()
+	for _, u := range sess.users {
+		if u.online && u.nkey != sess.me.Subject && u.expires < now {
+			u.online = false
+			if len(sess.joined) > 0 {
+				sess.send(sess.prefix(u), "QUIT", "Went offline")
+			}
+		}
+	}
+}
+
+// Our channels as IRC channels.
+func ircChannels() []string {
+	var chans []string
+	for _, ch := range defaultChannels {
+		chans = append(chans, "#"+ch)
+	}
+	return chans
+}
+
+// The chat channel an IRC channel is, IRC channels ignore case.
+func chatChannel(name string) string {
+	if !strings.HasPrefix(name, "#") {
+		return ""
+	}
+	for _, ch := range defaultChannels {
+		if strings.EqualFold(ch, name[1:]) {
+			return ch
+		}
+	}
+	return ""
+}
+
+// Lock should be held. Chat names are not unique, nicks need to
+// be, so a clash gets part of the nkey.
+func (sess *ircSession) addUser(nkey, name string) *ircUser {
+	if u := sess.users[nkey]; u != nil {
+		return u
+	}
+	nick := ircNick(name)
+	if other, ok := sess.nicks[strings.ToLower(nick)]; ok && other != nkey {
+		nick += "|" + nkey[1:5]
+	}
+	u := &ircUser{nkey: nkey, nick: nick, name: name}
+	sess.users[nkey] = u
+	sess.nicks[strings.ToLower(nick)] = nkey
+	return u
+}
+
+// Keeps to the characters IRC allows in nicks.
+func ircNick(name string) string {
+	nick := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("_-[]\\`^{}|", r):
+			return r
+		}
+		return '_'
+	}, name)
+	if nick == "" || (nick[0] >= '0' && nick[0] <= '9') || nick[0] == '-' {
+		nick = "_" + nick
+	}
+	return nick
+}
+
+func (sess *ircSession) prefix(u *ircUser) string {
+	return u.nick + "!" + u.nkey[:shortKeyLen] + "@" + strings.ToLower(sess.srv.ws.Audience)
+}
+
+func (sess *ircSession) handle(cmd string, params []string) {
+	switch cmd {
+	case "JOIN", "PART", "PRIVMSG", "NAMES", "WHO", "TOPIC":
+		if len(params) == 0 {
+			sess.Lock()
+			sess.reply(errNeedMoreParam, cmd, "Not enough parameters")
+			sess.Unlock()
+			return
+		}
+	}
+	switch cmd {
+	case "PRIVMSG":
+		sess.privmsg(params)
+		return
+	case "", "PONG", "USER", "CAP", "NOTICE":
+		return
+	}
+
+	sess.Lock()
+	defer sess.Unlock()
+	switch cmd {
+	case "PING":
+		sess.send(ircServerName, "PONG", ircServerName, strings.Join(params, " "))
+	case "NICK":
+		sess.reply(errNoNickChange, "Your nick is your chat name")
+	case "JOIN":
+		if params[0] == "0" {
+			for ch := range sess.joined {
+				sess.part(ch)
+			}
+			return
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			sess.join(name)
+		}
+	case "PART":
+		for _, name := range strings.Split(params[0], ",") {
+			ch := chatChannel(name)
+			if !sess.joined[ch] {
+				sess.reply(errNotOnChannel, name, "You're not on that channel")
+				continue
+			}
+			sess.part(ch)
+		}
+	case "NAMES":
+		for _, name := range strings.Split(params[0], ",") {
+			if ch := chatChannel(name); ch != "" {
+				sess.names(ch)
+			}
+		}
+	case "WHO":
+		sess.who(params[0])
+	case "TOPIC":
+		sess.reply(rplNoTopic, params[0], "No topic is set")
+	case "MODE":
+		switch {
+		case len(params) == 0:
+		case chatChannel(params[0]) == "":
+			sess.reply(rplUModeIs, "+")
+		case len(params) == 1:
+			sess.reply(rplChannelModeIs, "#"+chatChannel(params[0]), "+nt")
+		case strings.Contains(params[1], "b"):
+			sess.reply(rplEndOfBanList, "#"+chatChannel(params[0]), "End of channel ban list")
+		}
+	default:
+		sess.reply(errUnknownCmd, cmd, "Unknown command")
+	}
+}
+
+// Lock should be held.
+func (sess *ircSession) join(name string) {
+	ch := chatChannel(name)
+	if ch == "" {
+		sess.reply(errNoSuchChannel, name, "No such channel, they are "+strings.Join(ircChannels(), " "))
+		return
+	}
+	if sess.joined[ch] {
+		return
+	}
+	sess.joined[ch] = true
+	sess.send(sess.prefix(sess.users[sess.me.Subject]), "JOIN", "#"+ch)
+	sess.reply(rplNoTopic, "#"+ch, "No topic is set")
+	sess.names(ch)
+}
+
+// Lock should be held.
+func (sess *ircSession) part(ch string) {
+	delete(sess.joined, ch)
+	sess.send(sess.prefix(sess.users[sess.me.Subject]), "PART", "#"+ch)
+}
+
+// Lock should be held. Us and who is online, sorted by nick.
+func (sess *ircSession) online() []*ircUser {
+	var users []*ircUser
+	for nkey, u := range sess.users {
+		if u.online || nkey == sess.me.Subject {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].nick < users[j].nick })
+	return users
+}
+
+// Lock should be held.
+func (sess *ircSession) names(ch string) {
+	var nicks []string
+	for _, u := range sess.online() {
+		nicks = append(nicks, u.nick)
+	}
+	for len(nicks) > 0 {
+		n := ircNamesPerLine
+		if n > len(nicks) {
+			n = len(nicks)
+		}
+		sess.reply(rplNamReply, "=", "#"+ch, strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	sess.reply(rplEndOfNames, "#"+ch, "End of /NAMES list")
+}
+
+// Lock should be held. For a channel or a nick.
+func (sess *ircSession) who(target string) {
+	var users []*ircUser
+	ch := "*"
+	if c := chatChannel(target); c != "" {
+		ch = "#" + c
+		users = sess.online()
+	} else if u := sess.users[sess.nicks[strings.ToLower(target)]]; u != nil {
+		users = append(users, u)
+	}
+	for _, u := range users {
+		away := "H"
+		if !u.online && u.nkey != sess.me.Subject {
+			away = "G"
+		}
+		sess.reply(rplWhoReply, ch, u.nkey[:shortKeyLen], strings.ToLower(sess.srv.ws.Audience), ircServerName, u.nick, away, "0 "+u.name)
+	}
+	sess.reply(rplEndOfWho, target, "End of /WHO list")
+}
+
+// Sends a chat-post to a channel, or a chat-dm to a nick.
+func (sess *ircSession) privmsg(params []string) {
+	if len(params) < 2 || params[1] == "" {
+		return
+	}
+	target, msg := params[0], params[1]
+	if strings.HasPrefix(msg, ctcpAction) {
+		msg = actionPrefix + strings.TrimSuffix(msg[len(ctcpAction):], "\x01")
+	} else if strings.HasPrefix(msg, "\x01") {
+		// Other CTCP, e.g. VERSION, has no place in chat.
+		return
+	}
+
+	ws := sess.srv.ws
+	sess.Lock()
+	var subj, to, kind string
+	if ch := chatChannel(target); ch != "" {
+		if !sess.joined[ch] {
+			sess.reply(errCannotSend, target, "Cannot send to channel, join it first")
+			sess.Unlock()
+			return
+		}
+		subj, to, kind = ws.subject(postsPub, ch), ch, "chat-post"
+	} else if nkey, ok := sess.nicks[strings.ToLower(target)]; ok {
+		subj, to, kind = ws.subject(dmsPub, nkey), nkey, "chat-dm"
+	} else {
+		sess.reply(errNoSuchNick, target, "No such nick")
+		sess.Unlock()
+		return
+	}
+	sess.Unlock()
+
+	parts := splitMsg(msg, payloadLimit(sess.me, sess.nc), func(msg string) int {
+		pjwt, _ := ws.newMsg(kind, to, sess.name, msg).Encode(sess.skp)
+		return len(pjwt)
+	})
+	for _, part := range parts {
+		sess.Lock()
+		allowed := sess.limiter.allow(time.Now())
+		if !allowed {
+			sess.send(ircServerName, "NOTICE", sess.nick, "Slow down, your message was not sent")
+		}
+		sess.Unlock()
+		if !allowed {
+			return
+		}
+		pjwt, err := ws.newMsg(kind, to, sess.name, part).Encode(sess.skp)
+		if err != nil {
+			return
+		}
+		sess.nc.Publish(subj, []byte(pjwt))
+	}
+}
+
+// Passes verified claims on to the client.
+func (sess *ircSession) receive(m *nats.Msg) {
+	c := sess.v.check(sess.nc, m.Data)
+	if c == nil || c.Issuer == sess.me.Subject {
+		return
+	}
+	sess.Lock()
+	defer sess.Unlock()
+	u := sess.addUser(c.Issuer, displayName(c.Name))
+
+	switch c.Type {
+	case "chat-online":
+		if c.Subject != c.Issuer {
+			return
+		}
+		if !u.online {
+			for ch := range sess.joined {
+				sess.send(sess.prefix(u), "JOIN", "#"+ch)
+			}
+		}
+		u.online = true
+		u.expires = c.Expires
+		if c.Tags.Contains("new") {
+			// So they know us before our next update.
+			go sess.publishOnlineStatus(false)
+		}
+	case "chat-post":
+		if ch := chatChannel("#" + c.Subject); sess.joined[ch] {
+			sess.sendMsg(u, "#"+ch, c)
+		}
+	case "chat-dm":
+		sess.sendMsg(u, sess.nick, c)
+	}
+}
+
+// Lock should be held. IRC messages are one line each, actions
+// are CTCP.
+func (sess *ircSession) sendMsg(u *ircUser, target string, c *jwt.GenericClaims) {
+	msg, _ := c.Data["msg"].(string)
+	action := strings.HasPrefix(msg, actionPrefix)
+	msg = strings.TrimPrefix(msg, actionPrefix)
+	for _, line := range strings.Split(msg, "\n") {
+		line = ircUnsafe.Replace(strings.TrimRight(line, "\r"))
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if action {
+			line = ctcpAction + line + "\x01"
+			action = false
+		}
+		sess.send(sess.prefix(u), "PRIVMSG", target, line)
+	}
+}
@@ -17,13 +17,19 @@ import (
 	"flag"
 	"log"
 	"os"
-	"time"
-
-	"github.com/nats-io/nats.go"
+	"path/filepath"
 )
 
 func usage() {
-	log.Printf("Usage: chat [-s server] [-creds file] [-n name]\n")
+	log.Printf("Usage: chat [-s server] [-creds file] [-n name] [-acc account-jwt] [-aud workspace] [-maxposts n] [-config file]\n")
+	log.Printf("       chat register [-s server] -creds request-creds [-reclaim chat-creds] [name]\n")
+	log.Printf("       chat revoke [-s server] -creds request-creds -admin admin-creds <user>\n")
+	log.Printf("       chat web [-s server] [-addr address] [-public] [-aud workspace] [-acc account-jwt] [-tlscert file -tlskey file]\n")
+	log.Printf("       chat ircd [-s server] [-addr address] [-public] [-aud workspace] [-acc account-jwt]\n")
+	log.Printf("       chat webhook [-s server] [-addr address] [-aud workspace] [-acc account-jwt] -creds bot-creds -hooks file\n")
+	log.Printf("       chat export [-s server] [-aud workspace] [-creds file] [-format json|md|txt] [-jwts] [-o file] channel|@user\n")
+	log.Printf("       chat import [-aud workspace] [-acc account-jwt] [-creds file] file...\n")
+	log.Printf("       chat verify -acc account-jwt [-aud workspace] file...\n")
 	flag.PrintDefaults()
 }
 
@@ -33,55 +39,123 @@ func showUsageAndExit(exitcode int) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "register":
+			log.SetFlags(0)
+			registerMain(os.Args[2:])
+			return
+		case "revoke":
+			log.SetFlags(0)
+			revokeMain(os.Args[2:])
+			return
+		case "web":
+			log.SetFlags(0)
+			webMain(os.Args[2:])
+			return
+		case "ircd":
+			log.SetFlags(0)
+			ircdMain(os.Args[2:])
+			return
+		case "webhook":
+			log.SetFlags(0)
+			webhookMain(os.Args[2:])
+			return
+		case "export":
+			log.SetFlags(0)
+			exportMain(os.Args[2:])
+			return
+		case "import":
+			log.SetFlags(0)
+			importMain(os.Args[2:])
+			return
+		case "verify":
+			log.SetFlags(0)
+			verifyMain(os.Args[2:])
+			return
+		}
+	}
+
 	var server = flag.String("s", "localhost", "NATS System")
+	var cfgFile = flag.String("config", filepath.Join(configDir(), configFile), "Config File")
 	var name = flag.String("n", "", "Override Chat Name")
 	var userCreds = flag.String("creds", "", "User Credentials File")
+	var accFile = flag.String("acc", "", "Account JWT File, to trust its signing keys")
+	var aud = flag.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var maxPosts = flag.Int("maxposts", defaultMaxPosts, "Posts kept in memory per channel or DM")
 
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
 
-	// Use UserCredentials
-	if *userCreds == "" {
-		showUsageAndExit(1)
-	}
-
-	// Initialize our state
-	s := newState(*userCreds)
-
-	// Connect to NATS system
-	log.Print("Connecting to NATS system")
-	opts := []nats.Option{nats.Name("KUBECON NATS Chat")}
-	opts = setupConnOptions(opts)
-	opts = append(opts, nats.UserCredentials(*userCreds))
-
-	// Connect to NATS
-	nc, err := nats.Connect(*server, opts...)
+	// Flags override the config file.
+	cfg, err := loadConfig(*cfgFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer nc.Close()
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["s"] && cfg.Server != "" {
+		*server = cfg.Server
+	}
+	if !set["creds"] && cfg.Creds != "" {
+		*userCreds = cfg.Creds
+	}
 
-	// Setup NATS and announce ourselves.
-	s.setupNATS(nc, *userCreds, *name)
+	// The flags give one workspace, otherwise the config may list several.
+	var spaces []*workspace
+	if set["creds"] || set["aud"] || len(cfg.Workspaces) == 0 {
+		ws := &workspace{Audience: *aud, Server: *server, Creds: *userCreds, Account: *accFile}
+		ws.setDefaults(*server)
+		spaces = append(spaces, ws)
+	} else {
+		spaces = cfg.Workspaces
+	}
+	for _, ws := range spaces {
+		if ws.Creds == "" {
+			showUsageAndExit(1)
+		}
+		if ws.Server == "" {
+			ws.Server = *server
+		}
+		if ws.Account == "" {
+			ws.Account = *accFile
+		}
+	}
 
-	// Setup terminal UI
-	ui := s.setupUI()
+	// Initialize our state, connect and announce ourselves.
+	a := &app{config: cfg}
+	for _, ws := range spaces {
+		a.spaces = append(a.spaces, newState(a, ws, *maxPosts))
+	}
+	for _, s := range a.spaces {
+		s.connect(*name)
+		defer s.nc.Close()
+	}
 
-	// Ctrl-C to exit.
-	ui.SetKeybinding("Ctrl+C", func() { ui.Quit() })
+	// Setup terminal UI
+	ui := a.setupUI()
 
-	// Setup expiration timer if the user expires.
-	if s.me.Expires > 0 {
-		expiresInSecs := time.Duration(s.me.Expires - time.Now().Unix())
-		time.AfterFunc(time.Second*expiresInSecs, func() {
-			ui.Quit()
-			log.Fatalf("Your credentials have expired.")
-		})
+	for _, s := range a.spaces {
+		s.start()
 	}
 
 	// Loop on UI.
 	if err := ui.Run(); err != nil {
 		log.Fatal(err)
 	}
+	for _, s := range a.spaces {
+		s.Lock()
+		s.dd.save()
+		s.saveHistory()
+		s.Unlock()
+	}
+
+	// The terminal is ours again, so errors are readable.
+	if a.exitErr != nil {
+		for _, s := range a.spaces {
+			s.nc.Close()
+		}
+		log.Fatal(a.exitErr)
+	}
 }
@@ -0,0 +1,226 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+// Posts carry the raw text, markup is only how we show it. Clients
+// that do not know about it show the text as is.
+const (
+	actionPrefix = "/me "
+	codeFence    = "```"
+)
+
+// Theme styles for markup.
+const (
+	styleBold   = "msg.bold"
+	styleItalic = "msg.italic"
+	styleCode   = "msg.code"
+	styleURL    = "msg.url"
+	styleAction = "msg.action"
+	styleNote   = "msg.note"
+)
+
+// Terminals have no italics we can count on, so it is underlined.
+func newTheme() *tui.Theme {
+	t := tui.NewTheme()
+	// tui-go defaults
+	t.SetStyle("list.item.selected", tui.Style{Reverse: tui.DecorationOn})
+	t.SetStyle("table.cell.selected", tui.Style{Reverse: tui.DecorationOn})
+	t.SetStyle("button.focused", tui.Style{Reverse: tui.DecorationOn})
+
+	t.SetStyle(styleBold, tui.Style{Bold: tui.DecorationOn})
+	t.SetStyle(styleItalic, tui.Style{Underline: tui.DecorationOn})
+	t.SetStyle(styleCode, tui.Style{Fg: tui.ColorCyan})
+	t.SetStyle(styleURL, tui.Style{Fg: tui.ColorBlue, Underline: tui.DecorationOn})
+	t.SetStyle(styleAction, tui.Style{Fg: tui.ColorMagenta})
+	t.SetStyle(styleNote, tui.Style{Fg: tui.ColorYellow})
+	return t
+}
+
+// span is a run of text in one style.
+type span struct {
+	text  string
+	style string
+}
+
+// URLs go first so markup characters in them are left alone.
+var inlineRe = regexp.MustCompile("(https?://[^\\s]+)|`([^`\\n]+)`|\\*([^*\\s](?:[^*\\n]*[^*\\s])?)\\*|_([^_\\s](?:[^_\\n]*[^_\\s])?)_")
+
+// Parses *bold*, _italic_, `code`, URLs and fenced code blocks.
+func parseMarkup(msg string) []span {
+	var spans []span
+	lines := strings.Split(msg, "\n")
+	inCode := false
+	for i, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), codeFence) {
+			// The fence line itself, with any language, is not shown.
+			inCode = !inCode
+			continue
+		}
+		if i > 0 && len(spans) > 0 {
+			spans = append(spans, span{text: "\n"})
+		}
+		if inCode {
+			spans = append(spans, span{l, styleCode})
+		} else {
+			spans = append(spans, parseInline(l)...)
+		}
+	}
+	return spans
+}
+
+func parseInline(l string) []span {
+	var spans []span
+	plain := 0
+	for pos := 0; pos < len(l); {
+		m := inlineRe.FindStringSubmatchIndex(l[pos:])
+		if m == nil {
+			break
+		}
+		start, end := pos+m[0], pos+m[1]
+		var sp span
+		switch {
+		case m[2] >= 0:
+			sp = span{l[start:end], styleURL}
+		case m[4] >= 0:
+			sp = span{l[pos+m[4] : pos+m[5]], styleCode}
+		case m[6] >= 0 && wordBoundary(l, start, end):
+			sp = span{l[pos+m[6] : pos+m[7]], styleBold}
+		case m[8] >= 0 && wordBoundary(l, start, end):
+			sp = span{l[pos+m[8] : pos+m[9]], styleItalic}
+		default:
+			// Like snake_case, not markup.
+			_, n := utf8.DecodeRuneInString(l[start:])
+			pos = start + n
+			continue
+		}
+		if plain < start {
+			spans = append(spans, span{text: l[plain:start]})
+		}
+		spans = append(spans, sp)
+		pos, plain = end, end
+	}
+	if plain < len(l) {
+		spans = append(spans, span{text: l[plain:]})
+	}
+	return spans
+}
+
+// Emphasis needs to start and end at word boundaries.
+func wordBoundary(l string, start, end int) bool {
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(l[:start])
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	if end < len(l) {
+		r, _ := utf8.DecodeRuneInString(l[end:])
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits spans into lines of at most width runes, breaking
+// between words where we can.
+func wrapSpans(spans []span, width int) [][]span {
+	if width < 1 {
+		width = 1
+	}
+	var lines [][]span
+	var line []span
+	w := 0
+	newLine := func() {
+		lines = append(lines, line)
+		line, w = nil, 0
+	}
+	add := func(text, style string) {
+		if n := len(line); n > 0 && line[n-1].style == style {
+			line[n-1].text += text
+		} else {
+			line = append(line, span{text, style})
+		}
+		w += utf8.RuneCountInString(text)
+	}
+	for _, sp := range spans {
+		for _, tok := range tokenize(sp.text) {
+			n := utf8.RuneCountInString(tok)
+			switch {
+			case tok == "\n":
+				newLine()
+			case unicode.IsSpace([]rune(tok)[0]):
+				// Spaces at a break are dropped.
+				if w+n <= width {
+					add(tok, sp.style)
+				} else if w > 0 {
+					newLine()
+				}
+			default:
+				if w > 0 && w+n > width {
+					newLine()
+				}
+				// Words longer than a line are split.
+				for r := []rune(tok); len(r) > 0; {
+					k := width - w
+					if k > len(r) {
+						k = len(r)
+					}
+					add(string(r[:k]), sp.style)
+					if r = r[k:]; len(r) > 0 {
+						newLine()
+					}
+				}
+			}
+		}
+	}
+	return append(lines, line)
+}
+
+// Splits text into words, runs of spaces and newlines.
+func tokenize(text string) []string {
+	var toks []string
+	start := 0
+	kind := func(r rune) int {
+		switch {
+		case r == '\n':
+			return 0
+		case unicode.IsSpace(r):
+			return 1
+		}
+		return 2
+	}
+	prev := -1
+	for i, r := range text {
+		k := kind(r)
+		if i > start && (k != prev || k == 0) {
+			toks = append(toks, text[start:i])
+			start = i
+		}
+		prev = k
+	}
+	if start < len(text) {
+		toks = append(toks, text[start:])
+	}
+	return toks
+}
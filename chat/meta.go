@@ -0,0 +1,628 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcusolsson/tui-go"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// Channel topics and pins are signed claims on meta.<channel>. The
+// latest one for the topic, or for each pinned post, wins. They are
+// kept with the history, and sent again to those who ask on
+// meta.<channel>.get, so they are checked like archived posts.
+const (
+	metaClaim  = jwt.ClaimType("chat-meta")
+	metaPub    = "meta.%s"
+	metaSub    = "meta.*"
+	metaGetPub = "meta.%s.get"
+	metaGetSub = "meta.*.get"
+	metaFile   = "meta.json"
+
+	topicKey = "topic"
+	pinKey   = "pin:"
+
+	maxTopicLen   = 200
+	maxPins       = 20
+	maxPinExcerpt = 80
+	minPinPrefix  = 6
+
+	// Members wait up to this long before answering, and do not
+	// if others sent all they would have.
+	metaAnswerWait = 2 * time.Second
+)
+
+// channelMeta holds the claims in effect for a channel, by key.
+// Unpins are only remembered while we run, so older pins sent by
+// those who missed them do not come back.
+type channelMeta struct {
+	claims   map[string]*postClaim
+	unpinned map[string]*postClaim
+	answer   *metaAnswer
+}
+
+// metaAnswer is a pending answer to a get, with the keys of the
+// claims no one sent since.
+type metaAnswer struct {
+	timer  *time.Timer
+	unseen map[string]bool
+}
+
+// pinsPane shows the pinned posts of the current channel
+// above the messages.
+type pinsPane struct {
+	shown bool
+
+	// UI Items
+	label *tui.Label
+	box   *tui.Box
+}
+
+// What a meta claim is about, empty if nothing we know.
+func metaKey(c *jwt.GenericClaims) string {
+	if _, ok := c.Data["topic"].(string); ok {
+		return topicKey
+	}
+	if jti, _ := c.Data["pin"].(string); jti != "" {
+		return pinKey + jti
+	}
+	return ""
+}
+
+// Latest wins, ties go to the larger jti so all agree.
+func newerMeta(c, than *postClaim) bool {
+	if c.IssuedAt != than.IssuedAt {
+		return c.IssuedAt > than.IssuedAt
+	}
+	return c.ID > than.ID
+}
+
+// A missing or unreadable file has no metadata.
+func (s *state) loadMeta() {
+	contents, err := ioutil.ReadFile(filepath.Join(s.history.dir, metaFile))
+	if err != nil {
+		return
+	}
+	var raws map[string][]string
+	if err := json.Unmarshal(contents, &raws); err != nil {
+		s.logErr("-ERR Ignoring bad metadata file: %v", err)
+		return
+	}
+	for _, claims := range raws {
+		for _, raw := range claims {
+			if c, err := jwt.DecodeGeneric(raw); err == nil && c.Type == metaClaim {
+				s.applyMeta(&postClaim{GenericClaims: c, raw: raw})
+			}
+		}
+	}
+}
+
+// Lock should be held.
+func (s *state) saveMeta() {
+	raws := make(map[string][]string)
+	for ch, cm := range s.meta {
+		for _, c := range cm.claims {
+			raws[ch] = append(raws[ch], c.raw)
+		}
+	}
+	contents, err := json.MarshalIndent(raws, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(s.history.dir, 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(s.history.dir, metaFile), contents, 0600)
+	}
+	if err != nil {
+		s.logErr("-ERR Could not save metadata: %v", err)
+	}
+}
+
+// Lock should be held. Returns true if c is now in effect. The
+// limits senders keep to are enforced here as well.
+func (s *state) applyMeta(c *postClaim) bool {
+	key := metaKey(c.GenericClaims)
+	if key == "" || s.posts[c.Subject] == nil {
+		return false
+	}
+	if topic, ok := c.Data["topic"].(string); ok && len([]rune(topic)) > maxTopicLen {
+		return false
+	}
+	cm := s.meta[c.Subject]
+	if cm == nil {
+		cm = &channelMeta{claims: make(map[string]*postClaim), unpinned: make(map[string]*postClaim)}
+		s.meta[c.Subject] = cm
+	}
+	cur := cm.claims[key]
+	if cur == nil {
+		cur = cm.unpinned[key]
+	}
+	if cur != nil && !newerMeta(c, cur) {
+		return false
+	}
+	if key == topicKey {
+		cm.claims[key] = c
+		return true
+	}
+	if on, _ := c.Data["on"].(bool); !on {
+		delete(cm.claims, key)
+		cm.unpinned[key] = c
+		return true
+	}
+	if cm.claims[key] == nil && len(s.pinned(c.Subject)) >= maxPins {
+		return false
+	}
+	delete(cm.unpinned, key)
+	cm.claims[key] = c
+	return true
+}
+
+// Lock should be held. The topic of ch and the claim that set it.
+func (s *state) topic(ch string) (string, *postClaim) {
+	if cm := s.meta[ch]; cm != nil && cm.claims[topicKey] != nil {
+		c := cm.claims[topicKey]
+		topic, _ := c.Data["topic"].(string)
+		return topic, c
+	}
+	return "", nil
+}
+
+// Lock should be held. Pin claims in effect for ch, oldest first.
+func (s *state) pinned(ch string) []*postClaim {
+	var pins []*postClaim
+	if cm := s.meta[ch]; cm != nil {
+		for key, c := range cm.claims {
+			if on, _ := c.Data["on"].(bool); on && strings.HasPrefix(key, pinKey) {
+				pins = append(pins, c)
+			}
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return newerMeta(pins[j], pins[i])
+	})
+	return pins
+}
+
+// Lock should be held.
+func (s *state) newMetaClaim(ch string) *postClaim {
+	mc := &postClaim{GenericClaims: jwt.NewGenericClaims(ch)}
+	mc.Type = metaClaim
+	mc.Name = s.name
+	mc.Audience = s.ws.Audience
+	setValidity(&mc.ClaimsData, postTTL)
+	return mc
+}
+
+// Lock should be held.
+func (s *state) sendMeta(mc *postClaim) {
+	if !s.nc.IsConnected() {
+		s.showInfo("Not connected, try again once we are")
+		return
+	}
+	if !s.limiter.allow(time.Now()) {
+		s.showInfo("Slow down, you are posting too fast")
+		return
+	}
+	mjwt, err := mc.Encode(s.skp)
+	if err == nil && len(mjwt) > s.maxPayload() {
+		err = fmt.Errorf("it is over %d bytes signed", s.maxPayload())
+	}
+	if err != nil {
+		s.showInfo("Could not sign channel metadata: %v", err)
+		return
+	}
+	mc.raw = mjwt
+	s.nc.Publish(s.ws.subject(metaPub, mc.Subject), []byte(mjwt))
+
+	// We do not hear ourselves, so apply locally.
+	if s.applyMeta(mc) {
+		s.saveMeta()
+		s.showInfo("%s", s.metaNotice(mc))
+		s.updateHeader()
+		s.updatePins()
+	}
+}
+
+// Lock should be held.
+func (s *state) metaNotice(c *postClaim) string {
+	if topic, ok := c.Data["topic"].(string); ok {
+		if topic == "" {
+			return "Topic cleared by " + c.Name
+		}
+		return "Topic set by " + c.Name + ": " + topic
+	}
+	if on, _ := c.Data["on"].(bool); on {
+		return "A post was pinned by " + c.Name + ", see /pins"
+	}
+	return "A post was unpinned by " + c.Name
+}
+
+// Receive a topic or pin, as it was set or sent again to those
+// who asked.
+func (s *state) processMeta(m *nats.Msg) {
+	c, err := jwt.DecodeGeneric(string(m.Data))
+	if err != nil || c.Type != metaClaim {
+		s.logErr("-ERR Received a bad channel metadata claim: %v", err)
+		return
+	}
+	// Claims are for the channel they arrive on.
+	tokens := strings.Split(m.Subject, ".")
+	if ch := tokens[len(tokens)-1]; c.Subject != ch {
+		s.logErr("-ERR Channel metadata for %q sent to %s", c.Subject, ch)
+		return
+	}
+	mc := &postClaim{GenericClaims: c, raw: string(m.Data)}
+	if err := checkArchivedClaim(s.ws, mc); err != nil {
+		s.logErr("-ERR Invalid channel metadata: %v", err)
+		return
+	}
+	key := metaKey(c)
+
+	s.Lock()
+	cm := s.meta[c.Subject]
+	if cm != nil && cm.claims[key] != nil && cm.claims[key].raw == mc.raw {
+		// Others answered with what we have.
+		if a := cm.answer; a != nil {
+			delete(a.unseen, key)
+			if len(a.unseen) == 0 {
+				a.timer.Stop()
+				cm.answer = nil
+			}
+		}
+		s.Unlock()
+		return
+	}
+	uc := s.ids[c.Issuer]
+	if uc == nil {
+		s.awaitIdentity(c.Issuer, nil, m, s.processMeta)
+		s.Unlock()
+		return
+	}
+	if s.remoteUsers[c.Issuer] != nil {
+		s.Unlock()
+		s.logErr("-ERR Channel metadata from %q of another account", c.Name)
+		return
+	}
+	// The user needs to have been valid when they set it, and
+	// allowed to post if they did just now. Only news is worth a
+	// notice, not what we missed.
+	live := checkTimes(&c.ClaimsData) == nil
+	err = s.trust.verifyArchivedUser(uc, c.IssuedAt)
+	if err == nil && live && !s.canPost(c.Subject, c.Issuer) {
+		err = fmt.Errorf("%q can not post to %s", c.Name, c.Subject)
+	}
+	if err != nil {
+		s.Unlock()
+		s.logErr("-ERR Invalid channel metadata: %v", err)
+		return
+	}
+	// Fresh claims are limited and checked for replays like posts.
+	// Older ones were sent again, and only count if they are newer
+	// than what we have.
+	if live && (!s.allowPost(mc) || s.postIsDupe(mc.ID, mc.Issuer, mc.Expires)) {
+		s.Unlock()
+		return
+	}
+	if !s.applyMeta(mc) {
+		s.Unlock()
+		return
+	}
+	s.saveMeta()
+	current := s.cur != nil && s.cur.kind == channel && s.cur.name == c.Subject
+	s.Unlock()
+
+	if current {
+		s.ui.Update(func() {
+			s.Lock()
+			defer s.Unlock()
+			s.updateHeader()
+			s.updatePins()
+			if live {
+				s.showInfo("%s", s.metaNotice(mc))
+			}
+		})
+	}
+}
+
+// Asks members for what we missed of each channel.
+func (s *state) requestMeta() {
+	for _, ch := range s.chans {
+		s.nc.Publish(s.ws.subject(metaGetPub, ch), nil)
+	}
+}
+
+// Someone asks for the metadata of a channel. We answer after a
+// while, unless others sent all we have by then.
+func (s *state) processMetaGet(m *nats.Msg) {
+	tokens := strings.Split(m.Subject, ".")
+	ch := tokens[len(tokens)-2]
+
+	s.Lock()
+	defer s.Unlock()
+	cm := s.meta[ch]
+	if cm == nil || len(cm.claims) == 0 || cm.answer != nil {
+		return
+	}
+	a := &metaAnswer{unseen: make(map[string]bool)}
+	for key := range cm.claims {
+		a.unseen[key] = true
+	}
+	wait := time.Duration(rand.Int63n(int64(metaAnswerWait)))
+	a.timer = time.AfterFunc(wait, func() { s.answerMeta(ch, a) })
+	cm.answer = a
+}
+
+func (s *state) answerMeta(ch string, a *metaAnswer) {
+	s.Lock()
+	cm := s.meta[ch]
+	if cm == nil || cm.answer != a {
+		s.Unlock()
+		return
+	}
+	cm.answer = nil
+	var raws []string
+	for key := range a.unseen {
+		if c := cm.claims[key]; c != nil {
+			raws = append(raws, c.raw)
+		}
+	}
+	s.Unlock()
+
+	subj := s.ws.subject(metaPub, ch)
+	for _, raw := range raws {
+		s.nc.Publish(subj, []byte(raw))
+	}
+}
+
+// Assume lock is held. Shows the topic, or sets it. A topic
+// of "-" clears it.
+func (s *state) setTopic(args []string) {
+	if s.cur == nil || s.cur.kind != channel {
+		s.showInfo("Only channels have topics")
+		return
+	}
+	ch := s.cur.name
+	if len(args) == 0 {
+		if topic, c := s.topic(ch); topic != "" {
+			s.showInfo("Topic of %s, set by %s %s: %s", ch, c.Name,
+				time.Unix(c.IssuedAt, 0).Format(s.app.config.Timestamp), topic)
+		} else {
+			s.showInfo("No topic is set for %s, /topic <text> sets one", ch)
+		}
+		return
+	}
+	if !s.canPost(ch, s.me.Subject) {
+		s.showInfo("You can not post to %s right now", ch)
+		return
+	}
+	topic := strings.Join(args, " ")
+	if topic == "-" {
+		topic = ""
+	}
+	if len([]rune(topic)) > maxTopicLen {
+		s.showInfo("Topic is too long, at most %d characters", maxTopicLen)
+		return
+	}
+	mc := s.newMetaClaim(ch)
+	mc.Data["topic"] = topic
+	s.sendMeta(mc)
+}
+
+// Assume lock is held. Pins or unpins a post of the current
+// channel by its jti, or a prefix of it.
+func (s *state) pin(on bool, args []string) {
+	if s.cur == nil || s.cur.kind != channel {
+		s.showInfo("Only channel posts can be pinned")
+		return
+	}
+	ch := s.cur.name
+	if len(args) != 1 {
+		s.showInfo("Usage: /pin <jti> | /unpin <jti>, the latest posts are:")
+		posts := s.posts[ch].slice()
+		if len(posts) > 5 {
+			posts = posts[len(posts)-5:]
+		}
+		for _, p := range posts {
+			s.showInfo("  %s %s: %s", p.ID, s.localUserName(p), pinExcerpt(p))
+		}
+		return
+	}
+	if !s.canPost(ch, s.me.Subject) {
+		s.showInfo("You can not post to %s right now", ch)
+		return
+	}
+
+	var jti, from, msg string
+	if on {
+		p, err := s.findChannelPost(ch, args[0])
+		if err != nil {
+			s.showInfo("%v", err)
+			return
+		}
+		if len(s.pinned(ch)) >= maxPins {
+			s.showInfo("%s has %d pins already, unpin one first", ch, maxPins)
+			return
+		}
+		jti, from, msg = p.ID, p.Name, pinExcerpt(p)
+	} else {
+		for _, c := range s.pinned(ch) {
+			if id, _ := c.Data["pin"].(string); strings.HasPrefix(id, args[0]) {
+				if jti != "" {
+					s.showInfo("More than one pin starts with %q", args[0])
+					return
+				}
+				jti = id
+			}
+		}
+		if jti == "" {
+			s.showInfo("No pin starts with %q, see /pins", args[0])
+			return
+		}
+	}
+	mc := s.newMetaClaim(ch)
+	mc.Data["pin"] = jti
+	mc.Data["on"] = on
+	if on {
+		// For those who do not have the post.
+		mc.Data["from"] = from
+		mc.Data["msg"] = msg
+	}
+	s.sendMeta(mc)
+}
+
+func pinExcerpt(p *postClaim) string {
+	msg, _ := p.Data["msg"].(string)
+	msg = strings.Join(strings.Fields(msg), " ")
+	if r := []rune(msg); len(r) > maxPinExcerpt {
+		msg = string(r[:maxPinExcerpt-3]) + "..."
+	}
+	return msg
+}
+
+// Lock should be held. Looks in memory, then in history. Posts
+// with the same jti are the same to us, the newest is used.
+func (s *state) findChannelPost(ch, prefix string) (*postClaim, error) {
+	if len(prefix) < minPinPrefix {
+		return nil, fmt.Errorf("Give at least %d characters of the jti", minPinPrefix)
+	}
+	posts, err := s.history.all(channelConv(ch))
+	if err != nil {
+		s.logErr("-ERR Could not load history: %v", err)
+	}
+	posts = append(posts, s.posts[ch].slice()...)
+
+	var found *postClaim
+	for i := len(posts) - 1; i >= 0; i-- {
+		p := posts[i]
+		if !strings.HasPrefix(p.ID, prefix) || (found != nil && found.ID == p.ID) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("More than one post starts with %q", prefix)
+		}
+		found = p
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No post in %s starts with %q", ch, prefix)
+	}
+	return found, nil
+}
+
+// Assume lock is held. The header of the message pane has the
+// channel topic.
+func (s *state) updateHeader() {
+	if s.msgsBox == nil || s.cur == nil {
+		return
+	}
+	title := userPrefix + s.cur.name
+	if s.cur.kind == channel {
+		title = channelPrefix + s.cur.name
+		if topic, _ := s.topic(s.cur.name); topic != "" {
+			title += ": " + topic
+		}
+	}
+	s.msgsBox.SetTitle(" " + title + " ")
+}
+
+// Assume lock is held. Toggles the pins pane with /pins.
+func (s *state) togglePins() {
+	pp := s.pinsPane
+	if pp.shown {
+		s.msgsBox.Remove(0)
+		pp.shown = false
+		return
+	}
+	s.msgsBox.Insert(0, pp.box)
+	pp.shown = true
+	s.updatePins()
+}
+
+// Assume lock is held. Pinned posts as we have them, or as the
+// pin says they were.
+func (s *state) updatePins() {
+	pp := s.pinsPane
+	if !pp.shown {
+		return
+	}
+	if s.cur == nil || s.cur.kind != channel {
+		pp.label.SetText("Only channels have pins")
+		return
+	}
+	pins := s.pinned(s.cur.name)
+	if len(pins) == 0 {
+		pp.label.SetText("Nothing is pinned in " + s.cur.name + ", /pin <jti> pins a post")
+		return
+	}
+	jtis := make([]string, 0, len(pins))
+	for _, c := range pins {
+		jti, _ := c.Data["pin"].(string)
+		jtis = append(jtis, jti)
+	}
+	posts := s.channelPosts(s.cur.name, jtis)
+	lines := make([]string, 0, len(pins))
+	for _, c := range pins {
+		jti, _ := c.Data["pin"].(string)
+		from, _ := c.Data["from"].(string)
+		msg, _ := c.Data["msg"].(string)
+		when, id := "", jti
+		if len(id) > minPinPrefix {
+			id = id[:minPinPrefix]
+		}
+		if p := posts[jti]; p != nil {
+			from, msg = s.localUserName(p), pinExcerpt(p)
+			when = time.Unix(p.IssuedAt, 0).Format(s.app.config.Timestamp) + " "
+		}
+		lines = append(lines, fmt.Sprintf("%s%s: %s (%s, pinned by %s)", when, from, msg, id, c.Name))
+	}
+	pp.label.SetText(strings.Join(lines, "\n"))
+}
+
+// Lock should be held. The posts of ch we have with the given jtis.
+// Most are still in memory, history is only read for the rest.
+func (s *state) channelPosts(ch string, jtis []string) map[string]*postClaim {
+	want := make(map[string]bool, len(jtis))
+	for _, jti := range jtis {
+		want[jti] = true
+	}
+	byID := make(map[string]*postClaim)
+	for _, p := range s.posts[ch].slice() {
+		if want[p.ID] {
+			byID[p.ID] = p
+		}
+	}
+	if len(byID) == len(want) {
+		return byID
+	}
+	posts, err := s.history.all(channelConv(ch))
+	if err != nil {
+		s.logErr("-ERR Could not load history: %v", err)
+	}
+	for _, p := range posts {
+		// Newer ones from memory win.
+		if want[p.ID] && byID[p.ID] == nil {
+			byID[p.ID] = p
+		}
+	}
+	return byID
+}
@@ -0,0 +1,187 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	modClaim     = jwt.ClaimType("chat-mod")
+	moderatorTag = "moderator"
+
+	// Moderation actions.
+	modDelete   = "delete"
+	modMute     = "mute"
+	modReadOnly = "readonly"
+
+	// Kicks are mutes in all channels.
+	allChannels = "*"
+	kickFor     = time.Hour
+)
+
+func (s *state) isModerator() bool {
+	return s.me.Tags.Contains(moderatorTag)
+}
+
+// Lock should be held. Checks the verified user JWT
+// of nkey for the moderator tag.
+func (s *state) isModeratorKey(nkey string) bool {
+	uc := s.ids[nkey]
+	return uc != nil && uc.Tags.Contains(moderatorTag)
+}
+
+// Lock should be held.
+func (s *state) newModClaim(ch, action string) *jwt.GenericClaims {
+	mc := jwt.NewGenericClaims(ch)
+	mc.Type = modClaim
+	mc.Name = s.name
+	mc.Audience = s.ws.Audience
+	setValidity(&mc.ClaimsData, postTTL)
+	mc.Data["action"] = action
+	return mc
+}
+
+// Lock should be held.
+func (s *state) sendModeration(mc *jwt.GenericClaims) {
+	mjwt, err := mc.Encode(s.skp)
+	if err != nil {
+		s.showInfo("Could not sign moderation: %v", err)
+		return
+	}
+	s.registerPost(mc.ID, mc.Expires)
+	s.nc.Publish(s.ws.subject(modSub), []byte(mjwt))
+
+	// We do not hear ourselves, so apply locally.
+	if notice, redraw := s.applyModeration(mc); redraw {
+		s.setPostsDisplay(s.cur)
+		s.showInfo("%s", notice)
+	}
+}
+
+// Receive a moderation action from a moderator.
+func (s *state) processModeration(m *nats.Msg) {
+	mc, err := jwt.DecodeGeneric(string(m.Data))
+	if err != nil || mc.Type != modClaim {
+		s.logErr("-ERR Received a bad moderation claim: %v", err)
+		return
+	}
+	if err := s.checkClaim(mc); err != nil {
+		s.logErr("-ERR Invalid moderation: %v", err)
+		return
+	}
+
+	s.Lock()
+	if s.ids[mc.Issuer] == nil {
+		s.awaitIdentity(mc.Issuer, nil, m, s.processModeration)
+		s.Unlock()
+		return
+	}
+	if !s.isModeratorKey(mc.Issuer) {
+		s.Unlock()
+		s.logErr("-ERR Moderation from non-moderator %q", mc.Name)
+		return
+	}
+	if s.postIsDupe(mc.ID, mc.Issuer, mc.Expires) {
+		s.Unlock()
+		return
+	}
+	notice, redraw := s.applyModeration(mc)
+	s.Unlock()
+
+	if redraw {
+		s.ui.Update(func() {
+			s.Lock()
+			s.setPostsDisplay(s.cur)
+			s.showInfo("%s", notice)
+			s.Unlock()
+		})
+	}
+}
+
+// Lock should be held. Returns a notice and whether
+// the current display is affected.
+func (s *state) applyModeration(mc *jwt.GenericClaims) (string, bool) {
+	ch := mc.Subject
+	action, _ := mc.Data["action"].(string)
+	target, _ := mc.Data["target"].(string)
+	current := s.cur != nil && s.cur.kind == channel && (s.cur.name == ch || ch == allChannels)
+
+	switch action {
+	case modDelete:
+		if r := s.posts[ch]; r != nil && r.remove(target) {
+			return "A post was removed by " + mc.Name, current
+		}
+	case modMute:
+		until := time.Unix(claimInt(mc.Data["until"]), 0)
+		if s.mutes[ch] == nil {
+			s.mutes[ch] = make(map[string]time.Time)
+		}
+		s.mutes[ch][target] = until
+		name := target
+		if u := s.users[target]; u != nil {
+			name = u.name
+		}
+		return name + " was muted by " + mc.Name + " until " + until.Format("15:04"), current
+	case modReadOnly:
+		on, _ := mc.Data["on"].(bool)
+		s.readonly[ch] = on
+		if on {
+			return "Channel set read-only by " + mc.Name, current
+		}
+		return "Channel opened by " + mc.Name, current
+	}
+	return "", false
+}
+
+// Lock should be held.
+func (s *state) isMuted(ch, nkey string) bool {
+	now := time.Now()
+	for _, c := range []string{ch, allChannels} {
+		if until, ok := s.mutes[c][nkey]; ok {
+			if now.Before(until) {
+				return true
+			}
+			delete(s.mutes[c], nkey)
+		}
+	}
+	return false
+}
+
+// Lock should be held. Decides if nkey may post to ch
+// given current mutes and read-only channels.
+func (s *state) canPost(ch, nkey string) bool {
+	if s.isModeratorKey(nkey) {
+		return true
+	}
+	return !s.readonly[ch] && !s.isMuted(ch, nkey)
+}
+
+// JSON numbers in claims are decoded as float64.
+func claimInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+// A space, the user and a space after the time.
+const msgIndent = 1 + 9 + 1
+
+// msgRow is a post or notice, only laid out when visible.
+type msgRow struct {
+	when  string
+	who   string
+	spans []span
+}
+
+// Wraps the text next to the time and user.
+func (r *msgRow) lines(width int) [][]span {
+	indent := utf8.RuneCountInString(r.when) + msgIndent
+	lines := wrapSpans(r.spans, width-indent)
+	for i, l := range lines {
+		pre := strings.Repeat(" ", indent)
+		if i == 0 {
+			pre = r.when + " " + postUser(r.who) + " "
+		}
+		lines[i] = append([]span{{text: pre}}, l...)
+	}
+	return lines
+}
+
+// msgView shows the tail of a conversation. Only rows that are on
+// screen are laid out and drawn, so long conversations stay cheap.
+type msgView struct {
+	tui.WidgetBase
+
+	rows   []msgRow
+	offset int // rows scrolled up from the bottom
+
+	// From the last draw.
+	top     int
+	visible int
+
+	// Called once we scroll to the first row.
+	onTop func()
+	atTop bool
+}
+
+func newMsgView() *msgView {
+	v := &msgView{}
+	v.SetSizePolicy(tui.Expanding, tui.Expanding)
+	return v
+}
+
+func (v *msgView) appendRow(r msgRow) {
+	v.rows = append(v.rows, r)
+	// Stay on the same rows if we are scrolled up.
+	if v.offset > 0 {
+		v.offset++
+	}
+}
+
+// Keeps the offset, so a redraw of the same conversation
+// does not move the view.
+func (v *msgView) removeRows() {
+	v.rows = v.rows[:0]
+	v.atTop = false
+}
+
+func (v *msgView) scroll(n int) {
+	v.offset += n
+	if max := len(v.rows) - 1; v.offset > max {
+		v.offset = max
+	}
+	if v.offset < 0 {
+		v.offset = 0
+	}
+}
+
+// Moves by a page, keeping a row from the last one.
+func (v *msgView) page(up bool) {
+	n := v.visible - 1
+	if n < 1 {
+		n = 1
+	}
+	if !up {
+		n = -n
+	}
+	v.scroll(n)
+}
+
+func (v *msgView) home() {
+	v.scroll(len(v.rows))
+}
+
+func (v *msgView) end() {
+	v.offset = 0
+}
+
+func (v *msgView) MinSizeHint() image.Point {
+	return image.Point{len(defaultTimeFormat) + msgIndent + 1, 1}
+}
+
+func (v *msgView) SizeHint() image.Point {
+	return v.MinSizeHint()
+}
+
+func drawSpans(p *tui.Painter, y int, spans []span) {
+	x := 0
+	for _, sp := range spans {
+		p.WithStyle(sp.style, func(p *tui.Painter) {
+			p.DrawText(x, y, sp.text)
+		})
+		x += utf8.RuneCountInString(sp.text)
+	}
+}
+
+// Height of the first n rows, up to a screen.
+func (v *msgView) height(n int, size image.Point) int {
+	h := 0
+	for i := 0; i < n && h < size.Y; i++ {
+		h += len(v.rows[i].lines(size.X))
+	}
+	return h
+}
+
+// Draws from the bottom up until we run out of room.
+func (v *msgView) Draw(p *tui.Painter) {
+	size := v.Size()
+	v.scroll(0)
+	// Do not leave room below the first row when scrolled all the way up.
+	for v.offset > 0 && v.height(len(v.rows)-v.offset, size) < size.Y {
+		v.offset--
+	}
+
+	y := size.Y
+	i := len(v.rows) - 1 - v.offset
+	for ; i >= 0 && y > 0; i-- {
+		lines := v.rows[i].lines(size.X)
+		y -= len(lines)
+		for j, l := range lines {
+			if y+j >= 0 {
+				drawSpans(p, y+j, l)
+			}
+		}
+	}
+	v.top = i + 1
+	v.visible = len(v.rows) - v.offset - v.top
+
+	if v.top == 0 && v.offset > 0 && !v.atTop && v.onTop != nil {
+		v.atTop = true
+		v.onTop()
+	}
+}
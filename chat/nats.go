@@ -14,6 +14,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -27,17 +28,17 @@ import (
 	"github.com/nats-io/nkeys"
 )
 
+// Subjects under our workspace, see workspace.subject.
 const (
-	audience  = "KUBECON"
-	preSub    = "chat.KUBECON."
-	onlineSub = preSub + "online"
-	postsSub  = preSub + "posts.*"
-	postsPub  = preSub + "posts.%s"
-	dmsPub    = preSub + "dms.%s"
+	onlineSub = "online"
+	postsSub  = "posts.*"
+	postsPub  = "posts.%s"
+	dmsPub    = "dms.%s"
+	modSub    = "mod"
 )
 
 // This will setup our subscriptions for the chat service.
-func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
+func (s *state) setupNATS(nc *nats.Conn, name string) {
 	s.nc = nc
 
 	// Allow override
@@ -48,23 +49,47 @@ func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
 	}
 
 	// Listen for new posts, direct msgs.
-	if _, err := nc.Subscribe(postsSub, s.processNewPost); err != nil {
+	if _, err := nc.Subscribe(s.ws.subject(postsSub), s.processNewPost); err != nil {
 		log.Fatalf("Could not subscribe to new posts: %v", err)
 	}
 
 	// Only listen for DMs for us.
-	dmsSub := fmt.Sprintf(dmsPub, s.me.Subject)
+	dmsSub := s.ws.subject(dmsPub, s.me.Subject)
 	if _, err := nc.Subscribe(dmsSub, s.processNewDM); err != nil {
 		log.Fatalf("Could not subscribe to new DMs: %v", err)
 	}
 
 	// Watch for others coming online.
-	if _, err := nc.Subscribe(onlineSub, s.processUserUpdate); err != nil {
+	if _, err := nc.Subscribe(s.ws.subject(onlineSub), s.processUserUpdate); err != nil {
 		log.Fatalf("Could not subscribe to online status: %v", err)
 	}
 
+	// Posts shared with us by other accounts.
+	for _, r := range s.remotes {
+		r := r
+		if _, err := nc.Subscribe(r.subject(s.ws.subject(postsSub)), func(m *nats.Msg) { s.receivePost(m, r) }); err != nil {
+			log.Fatalf("Could not subscribe to posts from %s: %v", r.name, err)
+		}
+	}
+
+	// Moderation actions.
+	if _, err := nc.Subscribe(s.ws.subject(modSub), s.processModeration); err != nil {
+		log.Fatalf("Could not subscribe to moderation: %v", err)
+	}
+
+	// Channel topics and pins, and others asking for them.
+	if _, err := nc.Subscribe(s.ws.subject(metaSub), s.processMeta); err != nil {
+		log.Fatalf("Could not subscribe to channel metadata: %v", err)
+	}
+	if _, err := nc.Subscribe(s.ws.subject(metaGetSub), s.processMetaGet); err != nil {
+		log.Fatalf("Could not subscribe to channel metadata requests: %v", err)
+	}
+
 	// Set our status to online.
 	s.sendFirstOnlineStatus()
+
+	// Catch up on topics and pins set while we were away.
+	s.requestMeta()
 }
 
 const maxNameLen = 8
@@ -90,18 +115,28 @@ func (s *state) sendOnlineStatusUpdate() {
 }
 
 func (s *state) sendOnlineStatus(first bool) {
-	online := jwt.NewGenericClaims(s.me.Subject)
-	online.Name = s.name
-	online.Expires = time.Now().Add(onlineInterval).UTC().Unix() // 1 minute from now
+	s.publishOnlineStatus(first)
+
+	// Send periodically while running.
+	time.AfterFunc(onlineInterval/2, s.sendOnlineStatusUpdate)
+}
+
+func (s *state) publishOnlineStatus(first bool) {
+	ojwt, _ := s.ws.newOnline(s.me.Subject, s.name, first).Encode(s.skp)
+	s.nc.Publish(s.ws.subject(onlineSub), []byte(ojwt))
+}
+
+// The first one is tagged new, so others answer with theirs.
+func (ws *workspace) newOnline(nkey, name string, first bool) *jwt.GenericClaims {
+	online := jwt.NewGenericClaims(nkey)
+	online.Name = name
+	online.Audience = ws.Audience
+	setValidity(&online.ClaimsData, onlineInterval) // 1 minute from now
 	online.Type = jwt.ClaimType("chat-online")
 	if first {
 		online.Tags.Add("new")
 	}
-	ojwt, _ := online.Encode(s.skp)
-	s.nc.Publish(onlineSub, []byte(ojwt))
-
-	// Send periodically while running.
-	time.AfterFunc(onlineInterval/2, s.sendOnlineStatusUpdate)
+	return online
 }
 
 func (s *state) processUserUpdate(m *nats.Msg) {
@@ -110,10 +145,12 @@ func (s *state) processUserUpdate(m *nats.Msg) {
 		s.logErr("-ERR Received a bad user update: %v", err)
 		return
 	}
-	vr := jwt.CreateValidationResults()
-	userClaim.Validate(vr)
-	if vr.IsBlocking(true) {
-		s.logErr("-ERR Blocking issues for user update:%+v", vr)
+	if err := s.checkClaim(userClaim); err != nil {
+		s.logErr("-ERR Invalid user update: %v", err)
+		return
+	}
+	if userClaim.Subject != userClaim.Issuer {
+		s.logErr("-ERR User update for %q not signed by them", userClaim.Name)
 		return
 	}
 
@@ -132,7 +169,7 @@ func (s *state) processUserUpdate(m *nats.Msg) {
 
 	if userClaim.Tags.Contains("new") {
 		// Now send out status as well so they know us before next update.
-		s.sendOnlineStatus(false)
+		s.publishOnlineStatus(false)
 	}
 }
 
@@ -140,56 +177,178 @@ func (s *state) postSubject() string {
 	var subj string
 	if s.cur.kind == direct {
 		if u := s.dms[s.cur.name]; u != nil {
-			subj = fmt.Sprintf(dmsPub, u.nkey)
+			subj = s.ws.subject(dmsPub, u.nkey)
 		}
 	} else {
-		subj = fmt.Sprintf(postsPub, s.cur.name)
+		subj = s.ws.subject(postsPub, s.cur.name)
 	}
 	return subj
 }
 
-// Called when we send a channel post
+// Called when we send a channel post. Returns nil
+// if we are posting faster than our rate limit. While
+// disconnected posts go to the outbox instead.
 func (s *state) sendPost(m string) *postClaim {
+	if !s.limiter.allow(time.Now()) {
+		return nil
+	}
 	newPost := s.newPost(m)
+	if !s.nc.IsConnected() || len(s.outbox.Entries) > 0 {
+		s.signPost(newPost)
+		s.queuePost(s.postSubject(), newPost)
+		// Behind posts that failed, try them all again.
+		if s.nc.IsConnected() {
+			go s.flushOutbox()
+		}
+		return newPost
+	}
 	pjwt, _ := newPost.Encode(s.skp)
-	s.registerPost(newPost.ID)
+	newPost.raw = pjwt
+	s.registerPost(newPost.ID, newPost.Expires)
 	s.nc.Publish(s.postSubject(), []byte(pjwt))
 	return newPost
 }
 
+// Lock should be held. Sends a message from the composer, in
+// parts if needed. Returns what could not be sent yet.
+func (s *state) submitPost(m string) string {
+	parts := s.splitPost(m)
+	if len(parts) > 1 {
+		s.showInfo("Message is too long for one post, sending it in %d parts", len(parts))
+	}
+	for i, part := range parts {
+		p := s.sendPost(part)
+		if p == nil {
+			return strings.Join(parts[i:], "")
+		}
+		s.addPostToCurrent(p)
+		s.msgs.appendRow(s.postEntry(p))
+	}
+	return ""
+}
+
+// Our max payload, from our user JWT if it sets one.
+func (s *state) maxPayload() int {
+	if max := s.me.Limits.Payload; max > 0 {
+		return int(max)
+	}
+	return int(s.nc.MaxPayload())
+}
+
+// Lock should be held. Splits a message so each signed post fits
+// in our max payload, at a line or word break if there is one.
+func (s *state) splitPost(m string) []string {
+	return splitMsg(m, s.maxPayload(), func(msg string) int {
+		pjwt, _ := s.newPost(msg).Encode(s.skp)
+		return len(pjwt)
+	})
+}
+
+// Splits a message so that size, of the claim it goes in, is at
+// most max for each part.
+func splitMsg(m string, max int, sizeOf func(string) int) []string {
+	size := func(msg []rune) int {
+		return sizeOf(string(msg))
+	}
+
+	var parts []string
+	rest := []rune(m)
+	for len(rest) > 0 {
+		if size(rest) <= max {
+			parts = append(parts, string(rest))
+			break
+		}
+		// The most runes that fit.
+		lo, hi := 1, len(rest)-1
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			if size(rest[:mid]) <= max {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		n := lo
+		for i := n - 1; i > n/2; i-- {
+			if rest[i] == '\n' || rest[i] == ' ' {
+				n = i + 1
+				break
+			}
+		}
+		parts = append(parts, string(rest[:n]))
+		rest = rest[n:]
+	}
+	return parts
+}
+
 func (s *state) checkPostClaim(claim string) *postClaim {
 	post, err := jwt.DecodeGeneric(claim)
 	if err != nil {
 		s.logErr("-ERR Received a bad post: %v", err)
 		return nil
 	}
-	vr := jwt.CreateValidationResults()
-	post.Validate(vr)
-	if vr.IsBlocking(true) {
-		s.logErr("-ERR Blocking issues for post:%+v", vr)
+	if err := s.checkClaim(post); err != nil {
+		s.logErr("-ERR Invalid post: %v", err)
 		return nil
 	}
-	return &postClaim{post}
+	return &postClaim{GenericClaims: post, raw: claim}
 }
 
 // Receive a new channel post from another user.
 func (s *state) processNewPost(m *nats.Msg) {
+	s.receivePost(m, nil)
+}
+
+// Posts from a remote account need to be from its users, and ours
+// from our users.
+func (s *state) receivePost(m *nats.Msg, r *remote) {
 	post := s.checkPostClaim(string(m.Data))
-	if post == nil || s.posts[post.Subject] == nil {
+	if post == nil {
 		return
 	}
 
 	s.Lock()
-	defer s.Unlock()
 
-	if s.postIsDupe(post.ID) {
+	// We need to have verified the issuer first.
+	if s.ids[post.Issuer] == nil {
+		s.awaitIdentity(post.Issuer, r, m, func(m *nats.Msg) { s.receivePost(m, r) })
+		s.Unlock()
+		return
+	}
+	if s.remoteUsers[post.Issuer] != r {
+		s.logErr("-ERR Post from %q on the wrong account", post.Name)
+		s.Unlock()
 		return
 	}
-	s.posts[post.Subject] = append(s.posts[post.Subject], post)
 
-	if s.cur.kind == channel && s.cur.name == post.Subject {
+	// Only posts we would keep take a place in the replay cache.
+	if s.posts[post.Subject] == nil || s.prefs.isBlocked(post.Issuer) ||
+		!s.canPost(post.Subject, post.Issuer) || !s.allowPost(post) ||
+		s.postIsDupe(post.ID, post.Issuer, post.Expires) {
+		s.Unlock()
+		return
+	}
+	s.storePost(channelConv(post.Subject), s.posts[post.Subject], post)
+
+	selected := s.cur.kind == channel && s.cur.name == post.Subject
+	// Muted channels do not get marked as unread.
+	markUnread := !selected && !s.unread[post.Subject] && !s.prefs.Muted[post.Subject]
+	if markUnread {
+		s.unread[post.Subject] = true
+	}
+	s.Unlock()
+
+	if selected {
 		s.ui.Update(func() {
-			s.msgs.AppendRow(s.postEntry(post))
+			s.Lock()
+			s.msgs.appendRow(s.postEntry(post))
+			s.Unlock()
+		})
+	} else if markUnread {
+		s.ui.Update(func() {
+			s.Lock()
+			s.updateChannelList()
+			s.Unlock()
 		})
 	}
 }
@@ -203,23 +362,52 @@ func (s *state) processNewDM(m *nats.Msg) {
 
 	s.Lock()
 
+	if s.ids[post.Issuer] == nil {
+		s.awaitIdentity(post.Issuer, nil, m, s.processNewDM)
+		s.Unlock()
+		return
+	}
+
 	// We don't allow DMs from new users. We should know the user already.
 	u := s.users[post.Issuer]
-	if u == nil {
+	if u == nil || u.nkey != post.Issuer || s.prefs.isBlocked(post.Issuer) ||
+		s.postIsDupe(post.ID, post.Issuer, post.Expires) {
+		s.Unlock()
+		return
+	}
+	selected := s.cur.kind == direct && s.cur.name == u.name
+
+	// Receipts for our own DMs.
+	if post.Type == ackClaim {
+		changed := s.processAck(post)
+		s.Unlock()
+		if changed && selected {
+			s.ui.Update(func() {
+				s.Lock()
+				s.setPostsDisplay(s.cur)
+				s.Unlock()
+			})
+		}
 		return
 	}
-	u.posts = append(u.posts, post)
+	s.storePost(directConv(u.nkey), u.posts, post)
+
+	// Let them know it arrived, or that we have seen it.
+	post.ack = ackDelivered
+	if selected {
+		post.ack = ackRead
+	}
+	s.sendAck(u.nkey, []string{post.ID}, post.ack)
 
 	// snapshot
 	ui := s.ui
 	msgs := s.msgs
-	selected := s.cur.kind == direct && s.cur.name == u.name
 	s.Unlock()
 
 	// Update display if we are currently being viewed.
 	if selected {
 		ui.Update(func() {
-			msgs.AppendRow(s.postEntry(post))
+			msgs.appendRow(s.postEntry(post))
 		})
 	} else {
 		ui.Update(func() {
@@ -239,30 +427,45 @@ func (s *state) userListSorted() []*user {
 	return users
 }
 
-// Lock should be held.
+// Rejected claims and other errors go to the diagnostics pane,
+// the terminal belongs to the UI. Lock may or may not be held.
 func (s *state) logErr(format string, args ...interface{}) {
-	if s.input.IsFocused() {
-		log.Printf(format, args...)
+	line := time.Now().Format("15:04:05 ") + fmt.Sprintf(format, args...)
+	if s.diag.add(line) && s.ui != nil {
+		// Never block the caller on the UI.
+		go s.ui.Update(s.showDiagnostics)
 	}
 }
 
 var nscDecoratedRe = regexp.MustCompile(`\s*(?:(?:[-]{3,}[^\n]*[-]{3,}\n)(.+)(?:\n\s*[-]{3,}[^\n]*[-]{3,}\n))`)
 
-func loadUser(creds string) (*jwt.UserClaims, nkeys.KeyPair) {
+func loadUser(creds string) (*jwt.UserClaims, nkeys.KeyPair, string) {
 	contents, err := ioutil.ReadFile(creds)
 	if err != nil {
 		log.Fatalf("Could not load user credentials: %v", err)
 	}
+	uc, kp, ujwt, err := parseCreds(contents)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return uc, kp, ujwt
+}
+
+// parseCreds decodes a creds file, as chat-access hands them out.
+func parseCreds(contents []byte) (*jwt.UserClaims, nkeys.KeyPair, string, error) {
 	items := nscDecoratedRe.FindAllSubmatch(contents, -1)
 	if len(items) != 2 {
-		log.Fatal("Expected user JWT and seed!")
+		return nil, nil, "", errors.New("Expected user JWT and seed!")
 	}
-	ujwt := items[0][1]
-	seed := items[1][1]
+	return decodeCreds(items[0][1], items[1][1])
+}
 
+// decodeCreds decodes a user JWT and its seed, which needs to be
+// that of the user.
+func decodeCreds(ujwt, seed []byte) (*jwt.UserClaims, nkeys.KeyPair, string, error) {
 	kp, err := nkeys.FromSeed(seed)
 	if err != nil {
-		log.Fatalf("Could not decode seed: %v", err)
+		return nil, nil, "", fmt.Errorf("Could not decode seed: %v", err)
 	}
 	for i := range seed {
 		seed[i] = 'x'
@@ -270,27 +473,15 @@ func loadUser(creds string) (*jwt.UserClaims, nkeys.KeyPair) {
 
 	uc, err := jwt.DecodeUserClaims(string(ujwt))
 	if err != nil {
-		log.Fatalf("Could not decode user: %v", err)
+		return nil, nil, "", fmt.Errorf("Could not decode user: %v", err)
+	}
+	if pub, _ := kp.PublicKey(); pub != uc.Subject {
+		return nil, nil, "", errors.New("Seed is not that of the user")
 	}
 	// Check if we have expired.
 	if uc.Expires > 0 && uc.Expires < time.Now().UTC().Unix() {
-		log.Fatalf("I'm sorry, credentials have expired.")
+		return nil, nil, "", errors.New("I'm sorry, credentials have expired.")
 	}
 
-	return uc, kp
-}
-
-func setupConnOptions(opts []nats.Option) []nats.Option {
-	totalWait := 10 * time.Minute
-	reconnectDelay := time.Second
-
-	opts = append(opts, nats.ReconnectWait(reconnectDelay))
-	opts = append(opts, nats.MaxReconnects(int(totalWait/reconnectDelay)))
-	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
-		log.Fatalf("Exiting: %v", nc.LastError())
-	}))
-	// We do not want to hear ourselves for this application.
-	opts = append(opts, nats.NoEcho())
-
-	return opts
+	return uc, kp, string(ujwt), nil
 }
@@ -0,0 +1,215 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/jwt"
+)
+
+const (
+	outboxFile = "outbox.json"
+
+	// How long we wait for the server to confirm a flush.
+	outboxFlushWait = 5 * time.Second
+)
+
+// Delivery state of our own posts, shown next to them.
+const (
+	postPending = "pending"
+	postSent    = "sent"
+	postFailed  = "failed"
+)
+
+// outboxEntry is a post written while we were disconnected. Posts
+// are only valid for a short time, so we keep what is needed to
+// sign them again when they are sent. Once published the signed
+// post is kept, and sent again unchanged while it is valid, so
+// receivers can tell it is the same post if it did arrive.
+type outboxEntry struct {
+	Subject string `json:"subject"` // where it is published
+	To      string `json:"to"`      // channel or user nkey, the claim subject
+	Type    string `json:"type"`
+	Msg     string `json:"msg"`
+	Raw     string `json:"raw,omitempty"` // as last published
+
+	post     *postClaim
+	restored bool // a DM from the last session, not shown yet
+}
+
+// outbox keeps posts in the order they were written, across
+// restarts, until they have been sent.
+type outbox struct {
+	path     string
+	Entries  []*outboxEntry `json:"entries"`
+	flushing bool
+}
+
+// A missing or unreadable file gives an empty outbox.
+func loadOutbox(path string) *outbox {
+	ob := &outbox{path: path}
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(contents, ob); err != nil {
+			log.Printf("Ignoring bad outbox file %q: %v", path, err)
+		}
+	}
+	return ob
+}
+
+func (ob *outbox) save() error {
+	if len(ob.Entries) == 0 {
+		err := os.Remove(ob.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	contents, err := json.MarshalIndent(ob, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ob.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ob.path, contents, 0600)
+}
+
+// Lock should be held. Posts left over from the last session
+// show up as pending in their channel until we send them. DMs
+// show up once we know the user, see restoreDMs.
+func (s *state) restoreOutbox() {
+	for _, e := range s.outbox.Entries {
+		c, err := jwt.DecodeGeneric(e.Raw)
+		if err != nil {
+			e.Raw = ""
+			c = jwt.NewGenericClaims(e.To)
+			c.Type = jwt.ClaimType(e.Type)
+			c.Data["msg"] = e.Msg
+		}
+		e.post = &postClaim{GenericClaims: c, raw: e.Raw, status: postPending}
+		switch e.Type {
+		case "chat-post":
+			if r := s.posts[e.To]; r != nil {
+				s.storePost(channelConv(e.To), r, e.post)
+			}
+		case "chat-dm":
+			e.restored = true
+		}
+	}
+	s.setQueued(len(s.outbox.Entries))
+}
+
+// Lock should be held. Shows the DMs to u left in the outbox
+// from the last session.
+func (s *state) restoreDMs(u *user) {
+	for _, e := range s.outbox.Entries {
+		if e.restored && e.To == u.nkey {
+			e.restored = false
+			s.storePost(directConv(u.nkey), u.posts, e.post)
+		}
+	}
+}
+
+// Lock should be held. Keeps a post for later, in order behind
+// any others still waiting.
+func (s *state) queuePost(subj string, p *postClaim) {
+	p.status = postPending
+	s.outbox.Entries = append(s.outbox.Entries, &outboxEntry{
+		Subject: subj,
+		To:      p.Subject,
+		Type:    string(p.Type),
+		Msg:     p.Data["msg"].(string),
+		post:    p,
+	})
+	if err := s.outbox.save(); err != nil {
+		s.logErr("-ERR Could not save outbox: %v", err)
+	}
+	s.setQueued(len(s.outbox.Entries))
+}
+
+// Lock should be held. Signs a post again so it is valid from now.
+func (s *state) signPost(p *postClaim) {
+	p.Name = s.name
+	p.Audience = s.ws.Audience
+	setValidity(&p.ClaimsData, postTTL)
+	p.raw, _ = p.Encode(s.skp)
+}
+
+// Sends what is in the outbox in order, once we are connected.
+// The server confirming a flush marks the posts as sent.
+func (s *state) flushOutbox() {
+	s.Lock()
+	if s.outbox.flushing || len(s.outbox.Entries) == 0 || !s.nc.IsConnected() {
+		s.Unlock()
+		return
+	}
+	s.outbox.flushing = true
+	entries := s.outbox.Entries
+	soon := time.Now().Add(outboxFlushWait).Unix()
+	for _, e := range entries {
+		if e.Raw == "" || e.post.Expires < soon {
+			s.signPost(e.post)
+			s.registerPost(e.post.ID, e.post.Expires)
+			e.Raw = e.post.raw
+		}
+	}
+	// Before publishing, so we send the same posts after a crash.
+	if err := s.outbox.save(); err != nil {
+		s.logErr("-ERR Could not save outbox: %v", err)
+	}
+	for _, e := range entries {
+		s.nc.Publish(e.Subject, []byte(e.Raw))
+	}
+	s.Unlock()
+
+	err := s.nc.FlushTimeout(outboxFlushWait)
+
+	s.Lock()
+	status := postSent
+	if err != nil {
+		s.logErr("-ERR Could not send outbox: %v", err)
+		status = postFailed
+	}
+	for _, e := range entries {
+		e.post.status = status
+	}
+	// Failed posts are sent again when we reconnect, posts written
+	// while we were flushing stay for the next round.
+	if err == nil {
+		s.outbox.Entries = s.outbox.Entries[len(entries):]
+	}
+	if err := s.outbox.save(); err != nil {
+		s.logErr("-ERR Could not save outbox: %v", err)
+	}
+	s.outbox.flushing = false
+	s.setQueued(len(s.outbox.Entries))
+	s.Unlock()
+
+	if s.ui != nil {
+		s.ui.Update(func() {
+			s.Lock()
+			s.setPostsDisplay(s.cur)
+			s.Unlock()
+		})
+	}
+	if err == nil {
+		s.flushOutbox()
+	}
+}
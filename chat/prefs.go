@@ -0,0 +1,87 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	configDirName = "natschat"
+	prefsFile     = "prefs.json"
+)
+
+// prefs are local lists kept across sessions. Blocked users are
+// keyed by nkey so changing display names does not get around a block.
+type prefs struct {
+	path    string
+	Blocked map[string]string `json:"blocked"` // nkey -> name when blocked
+	Muted   map[string]bool   `json:"muted"`   // channels
+}
+
+// Where we keep local state, e.g. ~/.config/natschat
+func configDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, configDirName)
+}
+
+// A missing or unreadable file gives empty preferences.
+func loadPrefs(path string) *prefs {
+	p := &prefs{path: path}
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(contents, p); err != nil {
+			log.Printf("Ignoring bad preferences file %q: %v", path, err)
+		}
+	}
+	if p.Blocked == nil {
+		p.Blocked = make(map[string]string)
+	}
+	if p.Muted == nil {
+		p.Muted = make(map[string]bool)
+	}
+	return p
+}
+
+func (p *prefs) save() error {
+	contents, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.path, contents, 0600)
+}
+
+func (p *prefs) isBlocked(nkey string) bool {
+	_, ok := p.Blocked[nkey]
+	return ok
+}
+
+// Looks up a blocked user's nkey by the name they had when blocked.
+func (p *prefs) blockedByName(name string) string {
+	for nkey, n := range p.Blocked {
+		if n == name {
+			return nkey
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+)
+
+const (
+	// Used when our creds carry no rate limit hint.
+	defaultPostsPerMin = 60
+	defaultBurst       = 5
+
+	// Receivers are more lenient than senders.
+	recvSlack = 2
+
+	// How long we collect dropped posts before reporting them.
+	throttleWindow = 10 * time.Second
+
+	// Rate limit hint tags, should match chat-access.
+	rateTag  = "rate:"
+	burstTag = "burst:"
+)
+
+// Simple token bucket. Not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMin, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(perMin) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) allow(now time.Time) bool {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Returns the rate limit hint chat-access placed in the user JWT,
+// or our defaults.
+func rateHint(tags jwt.TagList) (perMin, burst int) {
+	perMin, burst = defaultPostsPerMin, defaultBurst
+	for _, t := range tags {
+		switch {
+		case strings.HasPrefix(t, rateTag):
+			fmt.Sscanf(t[len(rateTag):], "%d", &perMin)
+		case strings.HasPrefix(t, burstTag):
+			fmt.Sscanf(t[len(burstTag):], "%d", &burst)
+		}
+	}
+	if perMin <= 0 || burst <= 0 {
+		return defaultPostsPerMin, defaultBurst
+	}
+	return perMin, burst
+}
+
+// Tracks posts received from a single issuer.
+type throttle struct {
+	tb      *tokenBucket
+	dropped map[string]int // per channel
+}
+
+// Lock should be held. Returns false if the issuer is over their
+// limit, in which case the post is counted and reported later.
+func (s *state) allowPost(p *postClaim) bool {
+	now := time.Now()
+	if now.Sub(s.throttlesPruned) > throttleWindow {
+		s.pruneThrottles(now)
+	}
+	t := s.throttles[p.Issuer]
+	if t == nil {
+		// The issuer is verified by now, so we have their hint.
+		var tags jwt.TagList
+		if uc := s.ids[p.Issuer]; uc != nil {
+			tags = uc.Tags
+		}
+		perMin, burst := rateHint(tags)
+		t = &throttle{tb: newTokenBucket(perMin*recvSlack, burst*recvSlack), dropped: make(map[string]int)}
+		s.throttles[p.Issuer] = t
+	}
+	if t.tb.allow(now) {
+		return true
+	}
+	if len(t.dropped) == 0 {
+		issuer := p.Issuer
+		time.AfterFunc(throttleWindow, func() { s.reportThrottled(issuer) })
+	}
+	t.dropped[p.Subject]++
+	return false
+}
+
+// Collapses the posts we dropped from an issuer into one notice
+// per channel, naming the channel unless it is the one we show.
+func (s *state) reportThrottled(issuer string) {
+	s.Lock()
+	t := s.throttles[issuer]
+	if t == nil {
+		s.Unlock()
+		return
+	}
+	dropped := t.dropped
+	t.dropped = make(map[string]int)
+	name := issuer
+	if u := s.users[issuer]; u != nil {
+		name = u.name
+	}
+	s.Unlock()
+
+	s.ui.Update(func() {
+		s.Lock()
+		defer s.Unlock()
+		for ch, n := range dropped {
+			if s.cur != nil && s.cur.kind == channel && s.cur.name == ch {
+				s.showInfo("%s sent %d more messages (hidden, too fast)", name, n)
+			} else {
+				s.showInfo("%s sent %d more messages to %s%s (hidden, too fast)", name, n, channelPrefix, ch)
+			}
+		}
+	})
+}
+
+// Lock should be held. Forgets the buckets that have filled up
+// again, they are no different from new ones.
+func (s *state) pruneThrottles(now time.Time) {
+	for issuer, t := range s.throttles {
+		if len(t.dropped) > 0 {
+			continue
+		}
+		if t.tb.tokens+now.Sub(t.tb.last).Seconds()*t.tb.rate >= t.tb.burst {
+			delete(s.throttles, issuer)
+		}
+	}
+	s.throttlesPruned = now
+}
@@ -0,0 +1,103 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/nats-io/jwt"
+)
+
+const (
+	ackClaim = "chat-ack"
+
+	// Post IDs per ack, so it fits in our max payload.
+	maxAckIDs = 8
+)
+
+// Receipt states for DMs. Ours show what the recipient told us,
+// theirs what we told them.
+const (
+	ackNone = iota
+	ackDelivered
+	ackRead
+)
+
+var ackMarks = map[int]string{
+	ackDelivered: "✓",
+	ackRead:      "✓✓",
+}
+
+// Lock should be held. Acks are sent to the DM subject of whoever
+// sent us the posts.
+func (s *state) sendAck(nkey string, ids []string, state int) {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxAckIDs {
+			n = maxAckIDs
+		}
+		ack := jwt.NewGenericClaims(nkey)
+		ack.Name = s.name
+		ack.Audience = s.ws.Audience
+		ack.Type = jwt.ClaimType(ackClaim)
+		setValidity(&ack.ClaimsData, postTTL)
+		ack.Data["ids"] = ids[:n]
+		ack.Data["read"] = state == ackRead
+		ajwt, _ := ack.Encode(s.skp)
+		s.nc.Publish(s.ws.subject(dmsPub, nkey), []byte(ajwt))
+		ids = ids[n:]
+	}
+}
+
+// Lock should be held. Tells u we have seen what they sent us.
+func (s *state) ackRead(u *user) {
+	var ids []string
+	for _, p := range u.posts.slice() {
+		if p.Issuer == u.nkey && p.ack != ackRead {
+			p.ack = ackRead
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) > 0 && !s.prefs.isBlocked(u.nkey) {
+		s.sendAck(u.nkey, ids, ackRead)
+	}
+}
+
+// Lock should be held. Marks our DMs to the ack's issuer and
+// returns true if any changed.
+func (s *state) processAck(ack *postClaim) bool {
+	u := s.users[ack.Issuer]
+	if u == nil || ack.Subject != s.me.Subject {
+		s.logErr("-ERR Unexpected ack from %q", ack.Name)
+		return false
+	}
+	state := ackDelivered
+	if read, _ := ack.Data["read"].(bool); read {
+		state = ackRead
+	}
+	ids := make(map[string]bool)
+	if l, ok := ack.Data["ids"].([]interface{}); ok {
+		for _, id := range l {
+			if id, ok := id.(string); ok {
+				ids[id] = true
+			}
+		}
+	}
+	changed := false
+	for _, p := range u.posts.slice() {
+		if p.Issuer == s.me.Subject && ids[p.ID] && p.ack < state {
+			p.ack = state
+			changed = true
+		}
+	}
+	return changed
+}
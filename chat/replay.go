@@ -0,0 +1,168 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/jwt"
+)
+
+const (
+	// Validity window for the claims we send.
+	postTTL = 5 * time.Minute
+
+	// Longest validity window we accept, anything longer
+	// could be replayed after we forget about it.
+	maxClaimTTL = 10 * time.Minute
+
+	// Tolerance for clocks that are off.
+	clockSkew = 30 * time.Second
+
+	replayFile         = "replay.json"
+	replaySaveInterval = time.Minute
+
+	// Claim IDs we remember for one issuer. A sender at the default
+	// rate with the receiver slack uses about a quarter of it.
+	maxReplayPerIssuer = 5000
+)
+
+// Sets a tight validity window on a claim we are about to send.
+func setValidity(c *jwt.ClaimsData, ttl time.Duration) {
+	now := time.Now()
+	c.NotBefore = now.Unix()
+	c.Expires = now.Add(ttl).Unix()
+}
+
+// checkTimes allows for some clock skew, but requires an expiration
+// within maxClaimTTL so the replay cache only needs to remember
+// claims for a bounded time.
+func checkTimes(c *jwt.ClaimsData) error {
+	now := time.Now()
+	switch {
+	case c.Expires == 0:
+		return errors.New("claim has no expiration")
+	case c.Expires-c.IssuedAt > int64(maxClaimTTL/time.Second):
+		return errors.New("claim is valid for too long")
+	case c.Expires > now.Add(maxClaimTTL+clockSkew).Unix():
+		return errors.New("claim expires too far in the future")
+	case now.Add(-clockSkew).Unix() > c.Expires:
+		return errors.New("claim is expired")
+	case c.NotBefore > 0 && now.Add(clockSkew).Unix() < c.NotBefore:
+		return errors.New("claim is not yet valid")
+	}
+	return nil
+}
+
+// replayCache remembers claim IDs until the claim expires, after
+// which checkTimes rejects it anyway. It is kept across restarts.
+type replayCache struct {
+	path   string
+	seen   map[string]replayEntry // by jti
+	issued map[string]int         // entries per issuer
+}
+
+type replayEntry struct {
+	Until  int64  `json:"until"` // when we can forget it
+	Issuer string `json:"iss,omitempty"`
+}
+
+func newReplayCache(path string) *replayCache {
+	return &replayCache{
+		path:   path,
+		seen:   make(map[string]replayEntry),
+		issued: make(map[string]int),
+	}
+}
+
+// A missing or bad file gives an empty cache.
+func loadReplayCache(path string) *replayCache {
+	rc := newReplayCache(path)
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(contents, &rc.seen)
+	}
+	for _, e := range rc.seen {
+		rc.issued[e.Issuer]++
+	}
+	rc.prune(time.Now())
+	return rc
+}
+
+// Returns true if we have seen jti, otherwise remembers it. An
+// issuer with maxReplayPerIssuer claims that have not expired gets
+// the new ones refused until some do, others are not affected.
+func (rc *replayCache) check(jti, issuer string, exp int64) bool {
+	if _, ok := rc.seen[jti]; ok {
+		return true
+	}
+	if rc.issued[issuer] >= maxReplayPerIssuer {
+		if rc.prune(time.Now()); rc.issued[issuer] >= maxReplayPerIssuer {
+			return true
+		}
+	}
+	rc.add(jti, issuer, exp)
+	return false
+}
+
+func (rc *replayCache) add(jti, issuer string, exp int64) {
+	if exp == 0 {
+		exp = time.Now().Add(maxClaimTTL).Unix()
+	}
+	if _, ok := rc.seen[jti]; !ok {
+		rc.issued[issuer]++
+	}
+	rc.seen[jti] = replayEntry{Until: exp + int64(clockSkew/time.Second), Issuer: issuer}
+}
+
+// Forgets expired entries. Others could still be replayed, unless
+// they are further out than checkTimes allows, from an older cache.
+func (rc *replayCache) prune(now time.Time) {
+	ts := now.Unix()
+	max := now.Add(maxClaimTTL + 2*clockSkew).Unix()
+	for jti, e := range rc.seen {
+		if e.Until < ts || e.Until > max {
+			delete(rc.seen, jti)
+			if rc.issued[e.Issuer]--; rc.issued[e.Issuer] <= 0 {
+				delete(rc.issued, e.Issuer)
+			}
+		}
+	}
+}
+
+func (rc *replayCache) save() error {
+	rc.prune(time.Now())
+	contents, err := json.Marshal(rc.seen)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rc.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(rc.path, contents, 0600)
+}
+
+// Saves the replay cache periodically while running.
+func (s *state) saveReplayCache() {
+	s.Lock()
+	if err := s.dd.save(); err != nil {
+		s.logErr("-ERR Could not save replay cache: %v", err)
+	}
+	s.Unlock()
+	time.AfterFunc(replaySaveInterval, s.saveReplayCache)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nats-io/jwt"
+)
+
+const (
+	revokeReqSubj = "chat.req.revoke"
+	revokeClaim   = jwt.ClaimType("chat-revoke")
+	revokeTTL     = 2 * time.Minute
+)
+
+func revokeUsage() {
+	log.Printf("Usage: chat revoke [-s server] -creds request-creds -admin admin-creds <user>\n")
+}
+
+// Asks chat-access to revoke a user, given by name or public key.
+// The request is signed with the admin's credentials.
+func revokeMain(args []string) {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	var server = fs.String("s", "localhost", "NATS System")
+	var reqCreds = fs.String("creds", "", "Access Request Credentials File")
+	var adminCreds = fs.String("admin", "", "Admin Credentials File")
+	fs.Usage = func() {
+		revokeUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *reqCreds == "" || *adminCreds == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	_, kp, _ := loadUser(*adminCreds)
+	rc := jwt.NewGenericClaims(fs.Arg(0))
+	rc.Type = revokeClaim
+	rc.Expires = time.Now().Add(revokeTTL).Unix()
+	rjwt, err := rc.Encode(kp)
+	if err != nil {
+		log.Fatalf("Could not sign revocation request: %v", err)
+	}
+
+	resp := accessRequest(*server, *reqCreds, revokeReqSubj, []byte(rjwt))
+	log.Printf("%s: revoked %q", resp, fs.Arg(0))
+}
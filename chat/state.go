@@ -16,6 +16,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -30,26 +31,78 @@ type state struct {
 	sync.Mutex
 	nc    *nats.Conn
 	me    *jwt.UserClaims
+	ujwt  string
 	skp   nkeys.KeyPair
 	name  string
-	posts map[string][]*postClaim
+	chans []string
+	posts map[string]*postRing
 	dms   map[string]*user
 	users map[string]*user
-	dd    map[string]struct{}
+	dd    *replayCache
 	cur   *selection
 	ui    tui.UI
+	diag  *diagnostics
+
+	// Posts waiting for a connection.
+	outbox *outbox
+
+	// The workspace we are in, and the app holding all of them.
+	ws  *workspace
+	app *app
+
+	// Connection status.
+	status *connStatus
+
+	// Bounded posts in memory, older ones are in history.
+	maxPosts int
+	history  *history
+	older    int // posts from history shown for cur
+
+	// Local preferences and unread channels.
+	prefs  *prefs
+	unread map[string]bool
+
+	// Rate limiting, ours and others.
+	limiter         *tokenBucket
+	throttles       map[string]*throttle
+	throttlesPruned time.Time
+
+	// Verified user JWTs and messages waiting on them.
+	trust   *trust
+	ids     map[string]*jwt.UserClaims
+	ujwts   map[string]string // as issued, for exports
+	pending map[string][]pendingMsg
+
+	// Files we share and those we are downloading.
+	shared    map[string]*sharedFile
+	downloads map[string]bool
+
+	// Accounts sharing posts with us, and their users we verified.
+	remotes     []*remote
+	remoteUsers map[string]*remote
+
+	// Moderation
+	mutes    map[string]map[string]time.Time
+	readonly map[string]bool
+
+	// Channel topics and pins.
+	meta     map[string]*channelMeta
+	pinsPane *pinsPane
 
 	// UI Items
-	msgs     *tui.Grid
+	view     tui.Widget
+	chat     *tui.Box
+	msgsBox  *tui.Box
+	msgs     *msgView
 	channels *tui.List
 	direct   *tui.List
-	input    *tui.Entry
+	input    *composer
 }
 
 type user struct {
 	name  string
 	nkey  string
-	posts []*postClaim
+	posts *postRing
 	last  time.Time
 	disp  int
 	nmsgs bool
@@ -70,30 +123,80 @@ type selection struct {
 
 type postClaim struct {
 	*jwt.GenericClaims
+	raw    string
+	status string // of our own posts that went through the outbox
+	ack    int    // DM receipts, see receipts.go
 }
 
 // Fixed channels for now. Not hard to allow creating new ones.
+var defaultChannels = []string{"KUBECON", "NATS", "General"}
+
 func (s *state) pre() {
-	s.posts["KUBECON"] = []*postClaim{}
-	s.posts["NATS"] = []*postClaim{}
-	s.posts["General"] = []*postClaim{}
+	s.chans = append([]string(nil), defaultChannels...)
+	for _, ch := range s.chans {
+		s.posts[ch] = newPostRing(s.maxPosts)
+	}
 }
 
-func newState(creds string) *state {
+func newState(a *app, ws *workspace, maxPosts int) *state {
+	dir := ws.dataDir()
 	s := &state{
-		posts: make(map[string][]*postClaim),
+		ws:  ws,
+		app: a,
+
+		posts: make(map[string]*postRing),
 		dms:   make(map[string]*user),
 		users: make(map[string]*user),
-		dd:    make(map[string]struct{}),
+		dd:    loadReplayCache(filepath.Join(dir, replayFile)),
+
+		prefs:  loadPrefs(filepath.Join(dir, prefsFile)),
+		unread: make(map[string]bool),
+
+		throttles: make(map[string]*throttle),
+		diag:      &diagnostics{},
+		status:    &connStatus{},
+		outbox:    loadOutbox(filepath.Join(dir, outboxFile)),
+
+		maxPosts: maxPosts,
+		history:  newHistory(filepath.Join(configDir(), historyDir, ws.Audience)),
+
+		ids:     make(map[string]*jwt.UserClaims),
+		ujwts:   make(map[string]string),
+		pending: make(map[string][]pendingMsg),
+
+		shared:    make(map[string]*sharedFile),
+		downloads: make(map[string]bool),
+
+		remotes:     loadRemotes(ws.Remotes),
+		remoteUsers: make(map[string]*remote),
+
+		mutes:    make(map[string]map[string]time.Time),
+		readonly: make(map[string]bool),
+
+		meta:     make(map[string]*channelMeta),
+		pinsPane: &pinsPane{},
 	}
 	s.pre()
-	s.me, s.skp = loadUser(creds)
+	s.me, s.skp, s.ujwt = loadUser(ws.Creds)
+	s.trust = newTrust(s.me, ws.Account)
+	s.ids[s.me.Subject] = s.me
+	s.ujwts[s.me.Subject] = s.ujwt
+	s.limiter = newTokenBucket(rateHint(s.me.Tags))
+	s.restoreOutbox()
+	s.loadMeta()
 	return s
 }
 
+// DMs are to the nkey of the user, the name is only how we show them.
 func (s *state) newPost(msg string) *postClaim {
-	newPost := &postClaim{jwt.NewGenericClaims(s.cur.name)}
+	to := s.cur.name
+	if u := s.dms[s.cur.name]; s.cur.kind == direct && u != nil {
+		to = u.nkey
+	}
+	newPost := &postClaim{GenericClaims: jwt.NewGenericClaims(to)}
 	newPost.Name = s.name
+	newPost.Audience = s.ws.Audience
+	setValidity(&newPost.ClaimsData, postTTL)
 	newPost.Data["msg"] = msg
 	if s.cur.kind == direct {
 		newPost.Type = jwt.ClaimType("chat-dm")
@@ -103,8 +206,20 @@ func (s *state) newPost(msg string) *postClaim {
 	return newPost
 }
 
+// Starts on the configured channel, if we have it. The
+// workspace can have its own.
 func (s *state) selectFirstChannel() {
-	s.channels.Select(0)
+	first := s.ws.Channel
+	if first == "" {
+		first = s.app.config.Channel
+	}
+	i := 0
+	for j, ch := range s.chans {
+		if ch == strings.TrimPrefix(first, channelPrefix) {
+			i = j
+		}
+	}
+	s.channels.Select(i)
 	s.setPostsDisplay(s.chSel())
 }
 
@@ -151,31 +266,46 @@ func (s *state) dmSel() *selection {
 func (s *state) addPostToCurrent(p *postClaim) {
 	switch s.cur.kind {
 	case channel:
-		s.posts[s.cur.name] = append(s.posts[s.cur.name], p)
+		s.storePost(channelConv(s.cur.name), s.posts[s.cur.name], p)
 	case direct:
 		u := s.dms[s.cur.name]
-		u.posts = append(u.posts, p)
+		s.storePost(directConv(u.nkey), u.posts, p)
 	}
 }
 
 // Assume lock is held
 func (s *state) setPostsDisplay(sel *selection) {
+	if s.cur == nil || s.cur.kind != sel.kind || s.cur.name != sel.name {
+		s.older = 0
+		s.msgs.end()
+	}
 	s.cur = sel
-	s.msgs.RemoveRows()
+	s.msgs.removeRows()
 	var posts []*postClaim
 	switch sel.kind {
 	case channel:
-		posts = s.posts[sel.name]
+		posts = s.posts[sel.name].slice()
 		s.direct.SetSelected(-1)
 	case direct:
 		if u := s.dms[sel.name]; u != nil {
-			posts = u.posts
+			posts = u.posts.slice()
+			s.ackRead(u)
 		}
 		s.channels.SetSelected(-1)
 	}
+	// Older posts asked for with /more.
+	if s.older > 0 {
+		older, err := s.history.load(s.curConv(), 0, s.older)
+		if err != nil {
+			s.logErr("-ERR Could not load history: %v", err)
+		}
+		posts = append(older, posts...)
+	}
 	for _, p := range posts {
-		s.msgs.AppendRow(s.postEntry(p))
+		s.msgs.appendRow(s.postEntry(p))
 	}
+	s.updateHeader()
+	s.updatePins()
 }
 
 func (s *state) sameChannel() bool {
@@ -193,8 +323,9 @@ func (s *state) sameDirect() bool {
 }
 
 func (s *state) addNewUser(name, nkey string) *user {
-	u := &user{name, nkey, nil, time.Now(), 0, false}
+	u := &user{name, nkey, newPostRing(s.maxPosts), time.Now(), 0, false}
 	s.users[nkey] = u
+	s.restoreDMs(u)
 
 	du := s.dms[u.name]
 	if du == nil {
@@ -215,17 +346,13 @@ func (s *state) addNewUser(name, nkey string) *user {
 	return u
 }
 
-// Assume lock is held.
-// FIXME(dlc) - make this and posts bound.
-func (s *state) postIsDupe(jti string) bool {
-	if _, ok := s.dd[jti]; ok {
-		return true
-	}
-	s.registerPost(jti)
-	return false
+// Assume lock is held. Also protects against replays,
+// the claim's expiration bounds how long we remember it.
+func (s *state) postIsDupe(jti, issuer string, exp int64) bool {
+	return s.dd.check(jti, issuer, exp)
 }
 
-// Assume lock is held.
-func (s *state) registerPost(jti string) {
-	s.dd[jti] = struct{}{}
+// Assume lock is held. For claims we send ourselves.
+func (s *state) registerPost(jti string, exp int64) {
+	s.dd.add(jti, s.me.Subject, exp)
 }
@@ -0,0 +1,165 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/marcusolsson/tui-go"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// How often we measure the round trip to the server.
+	rttInterval = 5 * time.Second
+	rttTimeout  = 2 * time.Second
+)
+
+const (
+	connConnected    = "connected"
+	connReconnecting = "reconnecting"
+	connClosed       = "closed"
+)
+
+// connStatus is what the status bar shows. It has its own lock
+// since the NATS handlers run outside the UI and state locks.
+type connStatus struct {
+	sync.Mutex
+	state  string
+	url    string
+	rtt    time.Duration
+	queued int // posts waiting in the outbox
+
+	// UI Items
+	label *tui.Label
+}
+
+func (cs *connStatus) String() string {
+	cs.Lock()
+	defer cs.Unlock()
+	switch cs.state {
+	case connConnected:
+		if cs.queued > 0 {
+			return fmt.Sprintf(" Connected to %s  rtt %v  sending %d queued",
+				cs.url, cs.rtt.Round(time.Microsecond*100), cs.queued)
+		}
+		return fmt.Sprintf(" Connected to %s  rtt %v", cs.url, cs.rtt.Round(time.Microsecond*100))
+	case connReconnecting:
+		return fmt.Sprintf(" Reconnecting to %s...  %d queued", cs.url, cs.queued)
+	default:
+		return " Connection closed"
+	}
+}
+
+// Called in the UI goroutine.
+func (s *state) showStatus() {
+	s.status.label.SetText(s.status.String())
+}
+
+// Never blocks the caller on the UI.
+func (s *state) updateStatus() {
+	if s.ui != nil {
+		go s.ui.Update(s.showStatus)
+	}
+}
+
+func (s *state) setQueued(n int) {
+	s.status.Lock()
+	s.status.queued = n
+	s.status.Unlock()
+	s.updateStatus()
+}
+
+// Measures the round trip to the server periodically.
+func (s *state) measureRTT() {
+	if s.nc.IsConnected() {
+		start := time.Now()
+		if err := s.nc.FlushTimeout(rttTimeout); err == nil {
+			s.status.Lock()
+			s.status.rtt = time.Since(start)
+			s.status.Unlock()
+			s.updateStatus()
+		}
+	}
+	if !s.nc.IsClosed() {
+		time.AfterFunc(rttInterval, s.measureRTT)
+	}
+}
+
+func (s *state) setupConnOptions(opts []nats.Option) []nats.Option {
+	totalWait := 10 * time.Minute
+	reconnectDelay := time.Second
+
+	opts = append(opts, nats.ReconnectWait(reconnectDelay))
+	opts = append(opts, nats.MaxReconnects(int(totalWait/reconnectDelay)))
+	opts = append(opts, nats.DisconnectErrHandler(s.disconnected))
+	opts = append(opts, nats.ReconnectHandler(s.reconnected))
+	opts = append(opts, nats.ClosedHandler(s.closed))
+	// We do not want to hear ourselves for this application.
+	opts = append(opts, nats.NoEcho())
+
+	return opts
+}
+
+func (s *state) connected(nc *nats.Conn) {
+	s.status.Lock()
+	s.status.state = connConnected
+	s.status.url = nc.ConnectedUrl()
+	s.status.Unlock()
+	s.updateStatus()
+}
+
+func (s *state) disconnected(nc *nats.Conn, err error) {
+	if err != nil {
+		s.logErr("-ERR Disconnected: %v", err)
+	}
+	s.status.Lock()
+	if s.status.state != connClosed {
+		s.status.state = connReconnecting
+	}
+	s.status.Unlock()
+	s.updateStatus()
+}
+
+// Others may have dropped us while we were away, so we
+// announce ourselves again as new and send what we wrote.
+func (s *state) reconnected(nc *nats.Conn) {
+	s.connected(nc)
+	s.publishOnlineStatus(true)
+	s.requestMeta()
+	go s.flushOutbox()
+}
+
+func (s *state) closed(nc *nats.Conn) {
+	s.status.Lock()
+	s.status.state = connClosed
+	s.status.Unlock()
+	if s.ui == nil {
+		log.Fatalf("Exiting: %v", nc.LastError())
+	}
+	err := nc.LastError()
+	if err == nil {
+		err = nats.ErrConnectionClosed
+	}
+	// Other workspaces carry on without this one.
+	if len(s.app.spaces) > 1 {
+		s.logErr("-ERR %s connection closed: %v", s.ws.Name, err)
+		s.updateStatus()
+		return
+	}
+	s.app.quit(fmt.Errorf("Connection closed: %v", err))
+}
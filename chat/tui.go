@@ -15,16 +15,19 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/marcusolsson/tui-go"
 )
 
-func (s *state) setupUI() tui.UI {
+// Builds our widgets, the app shows them when we are the active
+// workspace.
+func (s *state) setupUI() tui.Widget {
 	s.channels = tui.NewList()
-	s.channels.AddItems(chName("KUBECON"), chName("NATS"), chName("General"))
+	for _, ch := range s.chans {
+		s.channels.AddItems(chName(ch))
+	}
 
 	s.direct = tui.NewList()
 
@@ -36,42 +39,78 @@ func (s *state) setupUI() tui.UI {
 		s.direct,
 		tui.NewSpacer(),
 	)
+	// Channels are shared with these accounts.
+	if len(s.remotes) > 0 {
+		shared := tui.NewVBox(tui.NewLabel(" SHARED WITH"))
+		for _, r := range s.remotes {
+			shared.Append(tui.NewLabel(chName(r.name)))
+		}
+		sidebar.Insert(3, shared)
+		sidebar.Insert(4, tui.NewLabel(""))
+	}
+	if len(s.app.spaces) > 1 {
+		sidebar.Prepend(tui.NewLabel(""))
+		sidebar.Prepend(s.app.list)
+		sidebar.Prepend(tui.NewLabel(" WORKSPACES"))
+	}
 	sidebar.SetBorder(true)
 
-	s.msgs = tui.NewGrid(4, 0)
+	s.msgs = newMsgView()
+	s.msgs.onTop = func() { go s.ui.Update(s.loadOlderOnTop) }
 
-	msgsScroll := tui.NewScrollArea(s.msgs)
-	msgsScroll.SetAutoscrollToBottom(true)
-	msgsBox := tui.NewVBox(msgsScroll)
+	msgsBox := tui.NewVBox(s.msgs)
 	msgsBox.SetBorder(true)
+	s.msgsBox = msgsBox
 
-	s.input = tui.NewEntry()
-	s.input.SetSizePolicy(tui.Expanding, tui.Maximum)
+	pp := s.pinsPane
+	pp.label = tui.NewLabel("")
+	pp.label.SetWordWrap(true)
+	pp.box = tui.NewVBox(pp.label)
+	pp.box.SetBorder(true)
+	pp.box.SetTitle("PINNED")
+	pp.box.SetSizePolicy(tui.Expanding, tui.Maximum)
+
+	s.input = newComposer()
 
 	inputBox := tui.NewHBox(s.input)
 	inputBox.SetBorder(true)
 	inputBox.SetSizePolicy(tui.Expanding, tui.Maximum)
 
+	s.diag.label = tui.NewLabel("")
+	s.diag.label.SetWordWrap(true)
+	s.diag.box = tui.NewVBox(s.diag.label)
+	s.diag.box.SetBorder(true)
+	s.diag.box.SetTitle("DIAGNOSTICS")
+	s.diag.box.SetSizePolicy(tui.Expanding, tui.Maximum)
+
 	chat := tui.NewVBox(msgsBox, inputBox)
 	chat.SetSizePolicy(tui.Expanding, tui.Expanding)
+	s.chat = chat
 
-	s.input.OnSubmit(func(e *tui.Entry) {
-		if m := e.Text(); m != "" {
+	s.input.OnSubmit(func(c *composer) {
+		if m := c.Text(); strings.TrimSpace(m) != "" {
+			c.addHistory(m)
 			s.Lock()
-			p := s.sendPost(m)
-			s.addPostToCurrent(p)
-			s.msgs.AppendRow(s.postEntry(p))
+			if isCommand(m) {
+				s.processCommand(m)
+			} else if s.cur.kind == channel && !s.canPost(s.cur.name, s.me.Subject) {
+				s.showInfo("You can not post to %s right now", s.cur.name)
+			} else if rest := s.submitPost(postText(m)); rest != "" {
+				// Keep the text so it can be sent again.
+				s.showInfo("Slow down, you are posting too fast")
+				s.Unlock()
+				c.SetText(rest)
+				return
+			}
 			s.Unlock()
-			e.SetText("")
+			c.SetText("")
 		}
 	})
 
-	root := tui.NewHBox(sidebar, chat)
+	s.status.label = tui.NewLabel(s.status.String())
+	s.status.label.SetSizePolicy(tui.Expanding, tui.Maximum)
 
-	ui, err := tui.New(root)
-	if err != nil {
-		log.Fatal(err)
-	}
+	root := tui.NewVBox(tui.NewHBox(sidebar, chat), s.status.label)
 
 	s.input.SetFocused(true)
 
@@ -79,21 +118,7 @@ func (s *state) setupUI() tui.UI {
 		s.channels.SetFocused(false)
 		s.input.SetFocused(true)
 	})
-	s.channels.OnSelectionChanged(func(l *tui.List) {
-		s.Lock()
-		defer s.Unlock()
-		if s.sameChannel() {
-			if s.cur.index > 0 {
-				s.channels.SetFocused(false)
-				s.direct.SetFocused(true)
-			}
-			return
-		}
-		if s.channels.Selected() >= 0 {
-			s.setPostsDisplay(s.chSel())
-			s.direct.SetSelected(-1)
-		}
-	})
+	s.channels.OnSelectionChanged(s.chSelChanged)
 
 	s.direct.OnItemActivated(func(l *tui.List) {
 		s.direct.SetFocused(false)
@@ -103,32 +128,28 @@ func (s *state) setupUI() tui.UI {
 
 	s.selectFirstChannel()
 
-	// Navigation
-	ui.SetKeybinding("TAB", func() {
-		s.Lock()
-		defer s.Unlock()
-		if s.input.IsFocused() {
-			s.input.SetFocused(false)
-			if s.cur == nil || s.cur.kind == channel {
-				s.direct.SetFocused(false)
-				s.channels.SetFocused(true)
-			} else {
-				s.channels.SetFocused(false)
-				s.direct.SetFocused(true)
-			}
-		} else {
-			s.channels.SetFocused(false)
-			s.direct.SetFocused(false)
-			s.input.SetFocused(true)
-		}
-	})
-
 	// Show ourselves on the DM list.
 	u := s.addNewUser(s.name, s.me.Subject)
 	s.direct.AddItems(dName(u))
+	return root
+}
 
-	s.ui = ui
-	return ui
+// Assume lock is held. Moves between the input and the lists.
+func (s *state) switchFocus() {
+	if s.input.IsFocused() {
+		s.input.SetFocused(false)
+		if s.cur == nil || s.cur.kind == channel {
+			s.direct.SetFocused(false)
+			s.channels.SetFocused(true)
+		} else {
+			s.channels.SetFocused(false)
+			s.direct.SetFocused(true)
+		}
+	} else {
+		s.channels.SetFocused(false)
+		s.direct.SetFocused(false)
+		s.input.SetFocused(true)
+	}
 }
 
 // Lock should not be held.
@@ -160,6 +181,42 @@ func (s *state) updateNewMsgState(nkey string, on bool) {
 	directL.OnSelectionChanged(s.dmSelChanged)
 }
 
+func (s *state) chSelChanged(l *tui.List) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sameChannel() {
+		if s.cur.index > 0 {
+			s.channels.SetFocused(false)
+			s.direct.SetFocused(true)
+		}
+		return
+	}
+	if s.channels.Selected() >= 0 {
+		s.setPostsDisplay(s.chSel())
+		s.direct.SetSelected(-1)
+		if s.unread[s.cur.name] {
+			delete(s.unread, s.cur.name)
+			s.updateChannelList()
+		}
+	}
+}
+
+// Assume lock is held. Redraws channel names with unread markers.
+func (s *state) updateChannelList() {
+	selIndex := s.channels.Selected()
+	s.channels.OnSelectionChanged(nil)
+	s.channels.RemoveItems()
+	for _, ch := range s.chans {
+		name := chName(ch)
+		if s.unread[ch] {
+			name = name + highlighted
+		}
+		s.channels.AddItems(name)
+	}
+	s.channels.SetSelected(selIndex)
+	s.channels.OnSelectionChanged(s.chSelChanged)
+}
+
 func (s *state) dmSelChanged(l *tui.List) {
 	s.Lock()
 	defer s.Unlock()
@@ -195,22 +252,37 @@ func postUser(u string) string {
 func (s *state) localUserName(p *postClaim) string {
 	u := s.users[p.Issuer]
 	if u == nil {
-		return p.Name
+		return s.remoteName(p.Issuer, p.Name)
 	}
 	return u.name
 }
 
-func (s *state) postEntry(p *postClaim) tui.Widget {
+func (s *state) postEntry(p *postClaim) msgRow {
 	t := time.Unix(p.IssuedAt, 0)
-	n := s.localUserName(p)
-
-	msgLabel := tui.NewLabel(p.Data["msg"].(string))
-	msgLabel.SetWordWrap(true)
+	row := msgRow{when: t.Format(s.app.config.Timestamp), who: s.localUserName(p)}
+	msg, _ := p.Data["msg"].(string)
+	if strings.HasPrefix(msg, actionPrefix) {
+		// Shown as "* name waves".
+		msg = row.who + " " + msg[len(actionPrefix):]
+		row.who = "*"
+		row.spans = []span{{msg, styleAction}}
+	} else {
+		row.spans = parseMarkup(msg)
+	}
+	if p.status != "" {
+		row.spans = append(row.spans, span{" [" + p.status + "]", styleNote})
+	}
+	if p.Type == "chat-dm" && p.Issuer == s.me.Subject && p.ack != ackNone {
+		row.spans = append(row.spans, span{" " + ackMarks[p.ack], styleNote})
+	}
+	return row
+}
 
-	return tui.NewHBox(
-		tui.NewLabel(t.Format("15:04")),
-		tui.NewPadder(1, 0, tui.NewLabel(postUser(n))),
-		msgLabel,
-		tui.NewSpacer(),
-	)
+// Assume lock is held. Shows a local notice in the message pane.
+func (s *state) showInfo(format string, args ...interface{}) {
+	s.msgs.appendRow(msgRow{
+		when:  time.Now().Format(s.app.config.Timestamp),
+		who:   "*",
+		spans: []span{{text: fmt.Sprintf(format, args...)}},
+	})
 }
@@ -0,0 +1,203 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+)
+
+// What chat verify finds for each post.
+const (
+	verdictOK       = "ok"
+	verdictTampered = "TAMPERED" // does not decode or its signature does not match
+	verdictForged   = "FORGED"   // not from a user of the account
+	verdictInvalid  = "INVALID"  // wrong audience or validity times
+	verdictUnsigned = "UNSIGNED" // exported without its JWT
+)
+
+// verdict is the result for one post of an archive.
+type verdict struct {
+	status string
+	post   *postClaim  // nil when it did not decode
+	shown  *exportPost // what a JSON transcript says about it
+	err    error
+}
+
+func verifyUsage() {
+	log.Printf("Usage: chat verify -acc account-jwt [-aud workspace] file...\n")
+}
+
+// Checks archived posts offline, against the account JWT only,
+// and reports on each of them. Exits non-zero if any fail.
+func verifyMain(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var accFile = fs.String("acc", "", "Account JWT File, the posts need to be from its users")
+	var aud = fs.String("aud", "", "Workspace, defaults to that of a JSON transcript or "+defaultAudience)
+	fs.Usage = func() {
+		verifyUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *accFile == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	t := accountTrust(loadAccount(expandHome(*accFile)))
+
+	failed := false
+	for _, file := range fs.Args() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ws := &workspace{Audience: *aud}
+		var tr transcript
+		if json.Unmarshal(data, &tr) == nil && ws.Audience == "" {
+			ws.Audience = tr.Workspace
+		}
+		ws.setDefaults("")
+
+		verdicts := verifyArchive(ws, t, data, tr.Posts)
+		if !reportVerdicts(file, ws, verdicts) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Posts of a JSON transcript are checked against their JWT, so
+// an edited msg shows up. Other files are checked for the claims
+// in them, how they are shown is not.
+func verifyArchive(ws *workspace, t *trust, data []byte, shown []*exportPost) []*verdict {
+	a, _ := readArchive(data)
+	var verdicts []*verdict
+	if len(shown) > 0 {
+		for _, ep := range shown {
+			v := &verdict{shown: ep}
+			if ep.JWT == "" {
+				v.status, v.err = verdictUnsigned, errors.New("exported without its JWT")
+			} else {
+				verifyClaim(ws, t, a, ep.JWT, v)
+				if v.status == verdictOK {
+					if err := ep.matches(v.post); err != nil {
+						v.status, v.err = verdictTampered, err
+					}
+				}
+			}
+			verdicts = append(verdicts, v)
+		}
+		return verdicts
+	}
+
+	for _, raw := range claimRe.FindAllString(string(data), -1) {
+		if c, err := jwt.DecodeGeneric(raw); err == nil && c.Type == jwt.UserClaim {
+			continue
+		}
+		v := &verdict{}
+		verifyClaim(ws, t, a, raw, v)
+		verdicts = append(verdicts, v)
+	}
+	return verdicts
+}
+
+func verifyClaim(ws *workspace, t *trust, a *archive, raw string, v *verdict) {
+	c, err := jwt.DecodeGeneric(raw)
+	if err != nil {
+		v.status, v.err = verdictTampered, err
+		return
+	}
+	v.post = &postClaim{GenericClaims: c, raw: raw}
+	if c.Type != "chat-post" && c.Type != "chat-dm" {
+		v.status, v.err = verdictInvalid, fmt.Errorf("not a post but %q", c.Type)
+		return
+	}
+	if err := checkArchivedClaim(ws, v.post); err != nil {
+		v.status, v.err = verdictInvalid, err
+		return
+	}
+	if err := a.verifyIssuer(t, v.post); err != nil {
+		v.status, v.err = verdictForged, err
+		return
+	}
+	v.status = verdictOK
+}
+
+// What a transcript shows needs to be what was signed.
+func (ep *exportPost) matches(p *postClaim) error {
+	msg, _ := p.Data["msg"].(string)
+	switch {
+	case ep.Msg != msg:
+		return errors.New("msg is not what was signed")
+	case ep.From != p.Issuer:
+		return errors.New("from is not who signed it")
+	case ep.Name != p.Name:
+		return errors.New("name is not what was signed")
+	case ep.To != p.Subject:
+		return errors.New("to is not what was signed")
+	case ep.ID != p.ID:
+		return errors.New("id is not that of the JWT")
+	case ep.Time.Unix() != p.IssuedAt:
+		return errors.New("time is not when it was signed")
+	}
+	return nil
+}
+
+// Prints a line per post and a summary, returns true if all of
+// them are ok.
+func reportVerdicts(file string, ws *workspace, verdicts []*verdict) bool {
+	fmt.Printf("%s, workspace %s:\n", file, ws.Audience)
+	counts := make(map[string]int)
+	for i, v := range verdicts {
+		counts[v.status]++
+		when, name, msg := "-", "-", ""
+		switch {
+		case v.post != nil:
+			when = time.Unix(v.post.IssuedAt, 0).Format(exportTimeFormat)
+			name = v.post.Name
+			msg, _ = v.post.Data["msg"].(string)
+		case v.shown != nil:
+			when = v.shown.Time.Format(exportTimeFormat)
+			name = v.shown.Name
+			msg = v.shown.Msg
+		}
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i] + " ..."
+		}
+		fmt.Printf("  %4d %-8s %s %-8s %s\n", i+1, v.status, when, name, msg)
+		if v.err != nil {
+			fmt.Printf("       %v\n", v.err)
+		}
+	}
+	fmt.Printf("%d posts: %d ok", len(verdicts), counts[verdictOK])
+	for _, status := range []string{verdictTampered, verdictForged, verdictInvalid, verdictUnsigned} {
+		if counts[status] > 0 {
+			fmt.Printf(", %d %s", counts[status], strings.ToLower(status))
+		}
+	}
+	fmt.Println()
+	return len(verdicts) > 0 && counts[verdictOK] == len(verdicts)
+}
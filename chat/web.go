@@ -0,0 +1,423 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultWebAddr = "localhost:8080"
+	webSocketPath  = "/ws"
+
+	// How long the browser has to log in, and to sign the
+	// nonce of the NATS server when it holds the seed.
+	webLoginWait = 30 * time.Second
+	webSignWait  = 10 * time.Second
+)
+
+// webMsg is what goes over the WebSocket, both ways. The browser
+// logs in with a creds file, and we sign for it, or with its user
+// JWT only, and it signs the connect nonce and its claims with the
+// seed it holds.
+type webMsg struct {
+	Type string `json:"type"`
+
+	Creds string `json:"creds,omitempty"` // login, we sign
+	JWT   string `json:"jwt,omitempty"`   // login, or a claim the browser signed
+	Nonce []byte `json:"nonce,omitempty"` // sign
+	Sig   []byte `json:"sig,omitempty"`   // sig, of the nonce
+
+	Name     string   `json:"name,omitempty"`
+	Nkey     string   `json:"nkey,omitempty"`
+	Audience string   `json:"aud,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	Channel  string   `json:"channel,omitempty"` // of a post
+	To       string   `json:"to,omitempty"`      // nkey a DM is for
+	Msg      string   `json:"msg,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	Time     int64    `json:"time,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func webUsage() {
+	log.Printf("Usage: chat web [-s server] [-addr address] [-public] [-aud workspace] [-acc account-jwt] [-tlscert file -tlskey file]\n")
+}
+
+// Serves the browser UI, with a WebSocket session per browser
+// that has its own NATS connection as its user.
+func webMain(args []string) {
+	fs := flag.NewFlagSet("web", flag.ExitOnError)
+	var server = fs.String("s", "localhost", "NATS System")
+	var addr = fs.String("addr", defaultWebAddr, "HTTP Listen Address")
+	var public = fs.Bool("public", false, "Allow listening on other than loopback without TLS, creds go in the clear")
+	var aud = fs.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var accFile = fs.String("acc", "", "Account JWT File, to trust its signing keys")
+	var tlsCert = fs.String("tlscert", "", "TLS Certificate File")
+	var tlsKey = fs.String("tlskey", "", "TLS Key File")
+	fs.Usage = func() {
+		webUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ws := &workspace{Server: *server, Audience: *aud}
+	ws.setDefaults(*server)
+	srv := &webServer{ws: ws}
+	if *accFile != "" {
+		srv.acc = loadAccount(*accFile)
+	}
+
+	http.HandleFunc("/", srv.serveIndex)
+	http.HandleFunc(webSocketPath, srv.serveSession)
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Browsers may send their seed, only local ones should in the clear.
+	if tcp, ok := l.Addr().(*net.TCPAddr); *tlsCert == "" && (!ok || !tcp.IP.IsLoopback()) {
+		if !*public {
+			log.Fatalf("Not listening on %s without TLS, it is not a loopback address, see -tlscert or -public", l.Addr())
+		}
+		log.Printf("Warning: no TLS, creds and posts go over the network in the clear")
+	}
+	log.SetFlags(log.LstdFlags)
+	log.Printf("Serving %s chat on %s", ws.Audience, l.Addr())
+	if *tlsCert != "" {
+		err = http.ServeTLS(l, nil, *tlsCert, *tlsKey)
+	} else {
+		err = http.Serve(l, nil)
+	}
+	log.Fatal(err)
+}
+
+type webServer struct {
+	ws       *workspace
+	acc      *jwt.AccountClaims
+	upgrader websocket.Upgrader
+}
+
+func (srv *webServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webIndex)
+}
+
+// webSession bridges one browser to NATS.
+type webSession struct {
+	sync.Mutex
+	srv  *webServer
+	conn *websocket.Conn
+	nc   *nats.Conn
+
+	me   *jwt.UserClaims
+	ujwt string
+	skp  nkeys.KeyPair // nil when the browser signs
+	name string
+	sigs chan []byte
+
+	v       *verifier
+	limiter *tokenBucket
+	done    chan struct{}
+	closed  bool
+}
+
+func (srv *webServer) serveSession(w http.ResponseWriter, r *http.Request) {
+	conn, err := srv.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sess := &webSession{
+		srv:  srv,
+		conn: conn,
+		sigs: make(chan []byte, 1),
+		done: make(chan struct{}),
+	}
+	defer close(sess.done)
+	if err := sess.login(); err != nil {
+		sess.send(&webMsg{Type: "error", Error: err.Error()})
+		return
+	}
+	go sess.connect()
+	sess.readLoop()
+
+	sess.Lock()
+	sess.closed = true
+	if sess.nc != nil {
+		sess.nc.Close()
+	}
+	sess.Unlock()
+}
+
+// The first message needs to be the login.
+func (sess *webSession) login() error {
+	var m webMsg
+	sess.conn.SetReadDeadline(time.Now().Add(webLoginWait))
+	if err := sess.conn.ReadJSON(&m); err != nil {
+		return errors.New("expected login")
+	}
+	sess.conn.SetReadDeadline(time.Time{})
+	if m.Type != "login" {
+		return errors.New("expected login")
+	}
+
+	var err error
+	switch {
+	case m.Creds != "":
+		sess.me, sess.skp, sess.ujwt, err = parseCreds([]byte(m.Creds))
+		if err != nil {
+			return err
+		}
+	case m.JWT != "":
+		if sess.me, err = jwt.DecodeUserClaims(m.JWT); err != nil {
+			return fmt.Errorf("bad user JWT: %v", err)
+		}
+		sess.ujwt = m.JWT
+	default:
+		return errors.New("login needs creds or a user JWT")
+	}
+
+	if sess.v, err = newVerifier(sess.srv.ws, sess.me, sess.srv.acc); err != nil {
+		return err
+	}
+	sess.name = displayName(sess.me.Name)
+	sess.limiter = newTokenBucket(rateHint(sess.me.Tags))
+	return nil
+}
+
+// Signs the connect nonce, or has the browser sign it.
+func (sess *webSession) sign(nonce []byte) ([]byte, error) {
+	if sess.skp != nil {
+		return sess.skp.Sign(nonce)
+	}
+	sess.send(&webMsg{Type: "sign", Nonce: nonce})
+	select {
+	case sig := <-sess.sigs:
+		return sig, nil
+	case <-time.After(webSignWait):
+		return nil, errors.New("browser did not sign the nonce")
+	case <-sess.done:
+		return nil, errors.New("browser went away")
+	}
+}
+
+func (sess *webSession) connect() {
+	ws := sess.srv.ws
+	opts := []nats.Option{
+		nats.Name(ws.Audience + " NATS Web Chat"),
+		nats.UserJWT(func() (string, error) { return sess.ujwt, nil }, sess.sign),
+		nats.NoEcho(),
+		nats.MaxReconnects(-1),
+		nats.ClosedHandler(func(nc *nats.Conn) { sess.conn.Close() }),
+	}
+	nc, err := nats.Connect(ws.Server, opts...)
+	if err != nil {
+		sess.send(&webMsg{Type: "error", Error: fmt.Sprintf("could not connect: %v", err)})
+		sess.conn.Close()
+		return
+	}
+	sess.Lock()
+	if sess.closed {
+		sess.Unlock()
+		nc.Close()
+		return
+	}
+	sess.nc = nc
+	sess.Unlock()
+
+	nc.Subscribe(ws.subject(postsSub), sess.receive)
+	nc.Subscribe(ws.subject(dmsPub, sess.me.Subject), sess.receive)
+	nc.Subscribe(ws.subject(onlineSub), sess.receive)
+
+	sess.send(&webMsg{
+		Type:     "welcome",
+		Name:     sess.name,
+		Nkey:     sess.me.Subject,
+		Audience: ws.Audience,
+		Channels: defaultChannels,
+	})
+
+	// The browser announces itself when it holds the seed.
+	if sess.skp != nil {
+		go sess.sendOnlineStatus()
+	}
+}
+
+func (sess *webSession) sendOnlineStatus() {
+	t := time.NewTicker(onlineInterval / 2)
+	defer t.Stop()
+	first := true
+	for {
+		online := sess.srv.ws.newOnline(sess.me.Subject, sess.name, first)
+		first = false
+		if ojwt, err := online.Encode(sess.skp); err == nil {
+			sess.nc.Publish(sess.srv.ws.subject(onlineSub), []byte(ojwt))
+		}
+		select {
+		case <-t.C:
+		case <-sess.done:
+			return
+		}
+	}
+}
+
+func (sess *webSession) send(m *webMsg) {
+	sess.Lock()
+	defer sess.Unlock()
+	sess.conn.WriteJSON(m)
+}
+
+func (sess *webSession) readLoop() {
+	for {
+		var m webMsg
+		if err := sess.conn.ReadJSON(&m); err != nil {
+			return
+		}
+		switch m.Type {
+		case "sig":
+			select {
+			case sess.sigs <- m.Sig:
+			default:
+			}
+		case "post":
+			sess.post(&m)
+		case "claim":
+			sess.publishClaim(m.JWT)
+		}
+	}
+}
+
+// Signs and sends a post or DM for the browser.
+func (sess *webSession) post(m *webMsg) {
+	if sess.skp == nil {
+		sess.send(&webMsg{Type: "error", Error: "Posts need to be signed in the browser"})
+		return
+	}
+	subj := m.Channel
+	kind := "chat-post"
+	if m.To != "" {
+		subj, kind = m.To, "chat-dm"
+	}
+	pjwt, err := sess.srv.ws.newMsg(kind, subj, sess.name, m.Msg).Encode(sess.skp)
+	if err != nil {
+		sess.send(&webMsg{Type: "error", Error: err.Error()})
+		return
+	}
+	sess.publishClaim(pjwt)
+}
+
+// Publishes a claim of our user where it belongs, and shows our
+// own posts since we do not get them back.
+func (sess *webSession) publishClaim(claim string) {
+	ws := sess.srv.ws
+	c, err := jwt.DecodeGeneric(claim)
+	if err == nil {
+		err = ws.checkClaim(c)
+	}
+	if err == nil && c.Issuer != sess.me.Subject {
+		err = errors.New("claim is not signed by you")
+	}
+	if err != nil {
+		sess.send(&webMsg{Type: "error", Error: fmt.Sprintf("Invalid claim: %v", err)})
+		return
+	}
+
+	var subj string
+	switch c.Type {
+	case "chat-post":
+		subj = ws.subject(postsPub, c.Subject)
+	case "chat-dm":
+		subj = ws.subject(dmsPub, c.Subject)
+	case "chat-online":
+		subj = ws.subject(onlineSub)
+	default:
+		sess.send(&webMsg{Type: "error", Error: fmt.Sprintf("Can not send %q claims", c.Type)})
+		return
+	}
+	if c.Type != "chat-online" && !sess.allow() {
+		sess.send(&webMsg{Type: "error", Error: "Slow down"})
+		return
+	}
+	if max := sess.me.Limits.Payload; max > 0 && int64(len(claim)) > max {
+		sess.send(&webMsg{Type: "error", Error: "Message is too long"})
+		return
+	}
+
+	sess.Lock()
+	nc := sess.nc
+	sess.Unlock()
+	if nc == nil {
+		sess.send(&webMsg{Type: "error", Error: "Not connected yet"})
+		return
+	}
+	if err := nc.Publish(subj, []byte(claim)); err != nil {
+		sess.send(&webMsg{Type: "error", Error: err.Error()})
+		return
+	}
+	if c.Type != "chat-online" {
+		sess.send(sess.webPost(c))
+	}
+}
+
+func (sess *webSession) allow() bool {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.limiter.allow(time.Now())
+}
+
+// Passes verified claims on to the browser.
+func (sess *webSession) receive(m *nats.Msg) {
+	c := sess.v.check(sess.nc, m.Data)
+	if c == nil {
+		return
+	}
+	switch c.Type {
+	case "chat-post", "chat-dm":
+		sess.send(sess.webPost(c))
+	case "chat-online":
+		if c.Subject == c.Issuer {
+			sess.send(&webMsg{Type: "online", Nkey: c.Issuer, Name: displayName(c.Name)})
+		}
+	}
+}
+
+func (sess *webSession) webPost(c *jwt.GenericClaims) *webMsg {
+	msg, _ := c.Data["msg"].(string)
+	m := &webMsg{Type: "post", Nkey: c.Issuer, Name: c.Name, Msg: msg, ID: c.ID, Time: c.IssuedAt}
+	if c.Type == "chat-dm" {
+		m.To = c.Subject
+	} else {
+		m.Channel = c.Subject
+	}
+	return m
+}
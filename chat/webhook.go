@@ -0,0 +1,497 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultHookAddr = ":8081"
+	hooksPath       = "/hooks/"
+
+	// Most we read of a request or a response.
+	maxHookBody = 64 * 1024
+
+	// How long an outgoing webhook has to answer.
+	hookTimeout = 10 * time.Second
+)
+
+// hooksConfig is the -hooks file of chat webhook, in TOML:
+//
+//	[[incoming]]
+//	name = "ci"
+//	token = "a long random secret"
+//	channels = ["NATS"]
+//
+//	[[outgoing]]
+//	name = "pager"
+//	url = "https://alerts.example.com/chat"
+//	token = "sent along so they know it is us"
+//	channels = ["NATS", "General"]
+//	match = "(?i)\\b(outage|sev1)\\b"
+//
+// Incoming webhooks post to the first of their channels unless the
+// payload names another of them.
+type hooksConfig struct {
+	Incoming []*inHook  `toml:"incoming"`
+	Outgoing []*outHook `toml:"outgoing"`
+}
+
+type inHook struct {
+	Name     string   `toml:"name"`
+	Token    string   `toml:"token"`
+	Channels []string `toml:"channels"`
+}
+
+// outHook POSTs the channel posts that match to its URL. No
+// channels is all of them, no match is every post.
+type outHook struct {
+	Name     string   `toml:"name"`
+	URL      string   `toml:"url"`
+	Token    string   `toml:"token"`
+	Channels []string `toml:"channels"`
+	Match    string   `toml:"match"`
+
+	re *regexp.Regexp
+}
+
+func loadHooks(path string) (*hooksConfig, error) {
+	c := &hooksConfig{}
+	if _, err := toml.DecodeFile(path, c); err != nil {
+		return nil, fmt.Errorf("could not load webhooks %q: %v", path, err)
+	}
+	names := make(map[string]bool)
+	for _, h := range c.Incoming {
+		if h.Name == "" || strings.Contains(h.Name, "/") || names[h.Name] {
+			return nil, fmt.Errorf("incoming webhook %q in %q needs a unique name without /", h.Name, path)
+		}
+		names[h.Name] = true
+		if h.Token == "" {
+			return nil, fmt.Errorf("incoming webhook %q in %q has no token", h.Name, path)
+		}
+		if len(h.Channels) == 0 {
+			return nil, fmt.Errorf("incoming webhook %q in %q has no channels", h.Name, path)
+		}
+		if err := checkChannels(h.Channels); err != nil {
+			return nil, fmt.Errorf("incoming webhook %q in %q: %v", h.Name, path, err)
+		}
+	}
+	for _, h := range c.Outgoing {
+		if h.URL == "" {
+			return nil, fmt.Errorf("outgoing webhook %q in %q has no url", h.Name, path)
+		}
+		if err := checkChannels(h.Channels); err != nil {
+			return nil, fmt.Errorf("outgoing webhook %q in %q: %v", h.Name, path, err)
+		}
+		re, err := regexp.Compile(h.Match)
+		if err != nil {
+			return nil, fmt.Errorf("outgoing webhook %q in %q: bad match: %v", h.Name, path, err)
+		}
+		h.re = re
+	}
+	return c, nil
+}
+
+// Channels may be given Slack style, with a #.
+func hookChannel(ch string) string {
+	return chatChannel("#" + strings.TrimPrefix(ch, "#"))
+}
+
+// Turns them into our names for them.
+func checkChannels(chans []string) error {
+	for i, ch := range chans {
+		if chans[i] = hookChannel(ch); chans[i] == "" {
+			return fmt.Errorf("no channel %q", ch)
+		}
+	}
+	return nil
+}
+
+func webhookUsage() {
+	log.Printf("Usage: chat webhook [-s server] [-addr address] [-aud workspace] [-acc account-jwt] -creds bot-creds -hooks file [-tlscert file -tlskey file]\n")
+}
+
+// Posts what systems that only speak HTTP send us, as a bot user,
+// and sends channel posts on to the ones that want them.
+func webhookMain(args []string) {
+	fs := flag.NewFlagSet("webhook", flag.ExitOnError)
+	var server = fs.String("s", "localhost", "NATS System")
+	var addr = fs.String("addr", defaultHookAddr, "HTTP Listen Address")
+	var aud = fs.String("aud", defaultAudience, "Workspace, subjects are under chat.<aud>")
+	var accFile = fs.String("acc", "", "Account JWT File, to trust its signing keys")
+	var creds = fs.String("creds", "", "Credentials File of the bot user")
+	var hooksFile = fs.String("hooks", "", "Webhooks File")
+	var tlsCert = fs.String("tlscert", "", "TLS Certificate File")
+	var tlsKey = fs.String("tlskey", "", "TLS Key File")
+	fs.Usage = func() {
+		webhookUsage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *creds == "" || *hooksFile == "" {
+		webhookUsage()
+		os.Exit(1)
+	}
+	hooks, err := loadHooks(expandHome(*hooksFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ws := &workspace{Server: *server, Audience: *aud, Creds: *creds}
+	ws.setDefaults(*server)
+	var acc *jwt.AccountClaims
+	if *accFile != "" {
+		acc = loadAccount(*accFile)
+	}
+
+	log.SetFlags(log.LstdFlags)
+	bot, err := newHookBot(ws, acc, hooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.HandleFunc(hooksPath, bot.serveHook)
+
+	log.Printf("Serving %d incoming and %d outgoing webhooks for %s on %s as %q",
+		len(hooks.Incoming), len(hooks.Outgoing), ws.Audience, *addr, bot.name)
+	if *tlsCert != "" {
+		err = http.ListenAndServeTLS(*addr, *tlsCert, *tlsKey, nil)
+	} else {
+		log.Printf("Warning: no TLS, tokens and posts go over the network in the clear")
+		err = http.ListenAndServe(*addr, nil)
+	}
+	log.Fatal(err)
+}
+
+// hookBot is the bot user webhooks post as.
+type hookBot struct {
+	sync.Mutex
+	ws    *workspace
+	hooks *hooksConfig
+	nc    *nats.Conn
+
+	me      *jwt.UserClaims
+	skp     nkeys.KeyPair
+	name    string
+	v       *verifier
+	limiter *tokenBucket
+	client  *http.Client
+}
+
+func newHookBot(ws *workspace, acc *jwt.AccountClaims, hooks *hooksConfig) (*hookBot, error) {
+	bot := &hookBot{ws: ws, hooks: hooks, client: &http.Client{Timeout: hookTimeout}}
+	var ujwt string
+	bot.me, bot.skp, ujwt = loadUser(ws.Creds)
+	v, err := newVerifier(ws, bot.me, acc)
+	if err != nil {
+		return nil, err
+	}
+	bot.v = v
+	bot.name = displayName(bot.me.Name)
+	bot.limiter = newTokenBucket(rateHint(bot.me.Tags))
+
+	opts := []nats.Option{
+		nats.Name(ws.Audience + " NATS Chat Webhooks"),
+		nats.UserJWT(func() (string, error) { return ujwt, nil }, bot.skp.Sign),
+		nats.NoEcho(),
+		nats.MaxReconnects(-1),
+	}
+	if bot.nc, err = nats.Connect(ws.Server, opts...); err != nil {
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
+	if len(hooks.Outgoing) > 0 {
+		bot.nc.Subscribe(ws.subject(postsSub), bot.receive)
+	}
+	return bot, nil
+}
+
+// slackPayload is what Slack incoming webhooks take, of which
+// we use the text parts.
+type slackPayload struct {
+	Text        string `json:"text"`
+	Channel     string `json:"channel"`
+	Username    string `json:"username"`
+	Attachments []struct {
+		Fallback  string `json:"fallback"`
+		Pretext   string `json:"pretext"`
+		Title     string `json:"title"`
+		TitleLink string `json:"title_link"`
+		Text      string `json:"text"`
+	} `json:"attachments"`
+	Blocks []struct {
+		Type string `json:"type"`
+		Text *struct {
+			Text string `json:"text"`
+		} `json:"text"`
+	} `json:"blocks"`
+}
+
+// Slack links are <url> or <url|label>.
+var slackLinkRe = regexp.MustCompile(`<([^|>]+)(?:\|([^>]+))?>`)
+
+func (p *slackPayload) msg() string {
+	var lines []string
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			lines = append(lines, s)
+		}
+	}
+	add(p.Text)
+	for _, b := range p.Blocks {
+		if b.Type == "section" && b.Text != nil {
+			add(b.Text.Text)
+		}
+	}
+	for _, a := range p.Attachments {
+		add(a.Pretext)
+		if a.TitleLink != "" {
+			add(a.Title + " " + a.TitleLink)
+		} else {
+			add(a.Title)
+		}
+		if a.Text != "" {
+			add(a.Text)
+		} else {
+			add(a.Fallback)
+		}
+	}
+	msg := strings.Join(lines, "\n")
+	msg = slackLinkRe.ReplaceAllStringFunc(msg, func(l string) string {
+		m := slackLinkRe.FindStringSubmatch(l)
+		if m[2] == "" {
+			return m[1]
+		}
+		return m[2] + " " + m[1]
+	})
+	if p.Username != "" && msg != "" {
+		msg = "[" + p.Username + "] " + msg
+	}
+	return msg
+}
+
+// POST /hooks/<name>, with the token as a bearer token, or Slack
+// style /hooks/<name>/<token>. The body is JSON, or a form with
+// it in payload.
+func (bot *hookBot) serveHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, hooksPath), "/")
+	var hook *inHook
+	for _, h := range bot.hooks.Incoming {
+		if h.Name == path[0] {
+			hook = h
+		}
+	}
+	if hook == nil {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(path) > 1 {
+		token = path[1]
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(hook.Token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxHookBody)
+	var body []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		body = []byte(r.FormValue("payload"))
+	} else {
+		body, err = ioutil.ReadAll(r.Body)
+	}
+	var p slackPayload
+	if err == nil {
+		err = json.Unmarshal(body, &p)
+	}
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	msg := p.msg()
+	if msg == "" {
+		http.Error(w, "no text", http.StatusBadRequest)
+		return
+	}
+	ch := hook.Channels[0]
+	if p.Channel != "" {
+		ch = ""
+		for _, c := range hook.Channels {
+			if c == hookChannel(p.Channel) {
+				ch = c
+			}
+		}
+		if ch == "" {
+			http.Error(w, "channel not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := bot.post(ch, msg); err != nil {
+		http.Error(w, err.Error(), postStatus(err))
+		return
+	}
+	io.WriteString(w, "ok")
+}
+
+var (
+	errSlowDown     = errors.New("slow down, posting faster than the bot's rate limit")
+	errNotConnected = errors.New("not connected to NATS, try again later")
+)
+
+// The HTTP status for an error posting, so callers know whether
+// to retry.
+func postStatus(err error) int {
+	switch err {
+	case errSlowDown:
+		return http.StatusTooManyRequests
+	case errNotConnected, nats.ErrConnectionClosed, nats.ErrConnectionDraining:
+		return http.StatusServiceUnavailable
+	case nats.ErrMaxPayload:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// Signs and sends a post, in parts if it is too long for one.
+func (bot *hookBot) post(ch, msg string) error {
+	if !bot.nc.IsConnected() {
+		return errNotConnected
+	}
+	parts := splitMsg(msg, payloadLimit(bot.me, bot.nc), func(msg string) int {
+		pjwt, _ := bot.ws.newMsg("chat-post", ch, bot.name, msg).Encode(bot.skp)
+		return len(pjwt)
+	})
+	for _, part := range parts {
+		bot.Lock()
+		allowed := bot.limiter.allow(time.Now())
+		bot.Unlock()
+		if !allowed {
+			return errSlowDown
+		}
+		pjwt, err := bot.ws.newMsg("chat-post", ch, bot.name, part).Encode(bot.skp)
+		if err != nil {
+			return err
+		}
+		if err := bot.nc.Publish(bot.ws.subject(postsPub, ch), []byte(pjwt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookPost is what outgoing webhooks get, the fields Slack
+// outgoing webhooks send.
+type hookPost struct {
+	Token       string `json:"token,omitempty"`
+	Workspace   string `json:"team_domain"`
+	Channel     string `json:"channel_name"`
+	UserID      string `json:"user_id"`
+	UserName    string `json:"user_name"`
+	Text        string `json:"text"`
+	Timestamp   string `json:"timestamp"`
+	TriggerWord string `json:"trigger_word,omitempty"`
+	ID          string `json:"message_id"`
+}
+
+// Sends channel posts on to the outgoing webhooks they match.
+func (bot *hookBot) receive(m *nats.Msg) {
+	c := bot.v.check(bot.nc, m.Data)
+	if c == nil || c.Type != "chat-post" {
+		return
+	}
+	msg, _ := c.Data["msg"].(string)
+	for _, h := range bot.hooks.Outgoing {
+		if !h.wants(c.Subject) {
+			continue
+		}
+		match := h.re.FindString(msg)
+		if match == "" && h.Match != "" {
+			continue
+		}
+		go bot.deliver(h, &hookPost{
+			Token:       h.Token,
+			Workspace:   bot.ws.Audience,
+			Channel:     c.Subject,
+			UserID:      c.Issuer,
+			UserName:    displayName(c.Name),
+			Text:        msg,
+			Timestamp:   fmt.Sprint(c.IssuedAt),
+			TriggerWord: match,
+			ID:          c.ID,
+		})
+	}
+}
+
+func (h *outHook) wants(ch string) bool {
+	if len(h.Channels) == 0 {
+		return true
+	}
+	for _, c := range h.Channels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// POSTs a post to an outgoing webhook. Like with Slack, a reply
+// with text is posted back to the channel.
+func (bot *hookBot) deliver(h *outHook, p *hookPost) {
+	body, _ := json.Marshal(p)
+	resp, err := bot.client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Outgoing webhook %q: %v", h.Name, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Outgoing webhook %q: %s", h.Name, resp.Status)
+		return
+	}
+	var reply slackPayload
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHookBody))
+	if json.Unmarshal(data, &reply) != nil {
+		return
+	}
+	if msg := reply.msg(); msg != "" {
+		if err := bot.post(p.Channel, msg); err != nil {
+			log.Printf("Outgoing webhook %q reply: %v", h.Name, err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The browser UI of chat web, see web.go. With the seed held in the
+// browser it signs with WebCrypto Ed25519, claims are encoded the
+// same way as nats-io/jwt v1 does, which signs the payload only.
+// Claim IDs only need to be unique, so they are a SHA-256 of the
+// claim rather than SHA-512/256.
+const webIndex = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NATS Chat</title>
+<style>
+body { margin: 0; font-family: sans-serif; height: 100vh; display: flex; }
+#login { margin: 2em auto; max-width: 40em; }
+#app { display: none; flex: 1; }
+#side { width: 14em; background: #222; color: #ddd; padding: .5em; overflow-y: auto; }
+#side h3 { font-size: .8em; color: #999; margin: 1em 0 .3em; }
+#side .item { cursor: pointer; padding: .1em .3em; }
+#side .sel { background: #444; }
+#side .unread { font-weight: bold; }
+#main { flex: 1; display: flex; flex-direction: column; }
+#msgs { flex: 1; overflow-y: auto; padding: .5em; }
+.msg { margin: .2em 0; white-space: pre-wrap; }
+.when { color: #888; margin-right: .5em; }
+.who { font-weight: bold; margin-right: .5em; }
+.action { color: #909; }
+.info { color: #a60; }
+#input { border-top: 1px solid #ccc; padding: .5em; }
+#input textarea { width: 100%; box-sizing: border-box; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<div id="login">
+<h2>NATS Chat</h2>
+<p>Your chat creds file, as chat-access handed it out:</p>
+<input type="file" id="credsFile"><br>
+<textarea id="creds" rows="10" cols="70" placeholder="or paste it here"></textarea><br>
+<label><input type="checkbox" id="local" checked> Keep the seed in this browser and sign here</label><br>
+<button id="connect">Connect</button>
+<p id="error"></p>
+</div>
+<div id="app">
+<div id="side">
+<h3>CHANNELS</h3><div id="chans"></div>
+<h3>DIRECT MESSAGES</h3><div id="users"></div>
+</div>
+<div id="main">
+<div id="msgs"></div>
+<div id="input"><textarea id="text" rows="2" placeholder="Enter sends, Shift+Enter starts a new line"></textarea></div>
+</div>
+</div>
+<script>
+var postTTL = 5 * 60, onlineTTL = 60, maxPosts = 1000;
+var ws, key = null, me = {}, cur = null;
+var posts = {}, users = {}, unread = {};
+
+function $(id) { return document.getElementById(id); }
+
+var B32 = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567';
+function b32decode(s) {
+  var bits = 0, val = 0, out = [];
+  for (var i = 0; i < s.length; i++) {
+    val = ((val << 5) | B32.indexOf(s[i])) & 0xffff;
+    bits += 5;
+    if (bits >= 8) {
+      out.push((val >>> (bits - 8)) & 255);
+      bits -= 8;
+    }
+  }
+  return new Uint8Array(out);
+}
+function b32encode(bytes) {
+  var bits = 0, val = 0, out = '';
+  for (var i = 0; i < bytes.length; i++) {
+    val = ((val << 8) | bytes[i]) & 0xffff;
+    bits += 8;
+    while (bits >= 5) {
+      out += B32[(val >>> (bits - 5)) & 31];
+      bits -= 5;
+    }
+  }
+  if (bits > 0) out += B32[(val << (5 - bits)) & 31];
+  return out;
+}
+function b64(bytes) {
+  var s = '';
+  for (var i = 0; i < bytes.length; i++) s += String.fromCharCode(bytes[i]);
+  return btoa(s);
+}
+function b64url(bytes) {
+  return b64(bytes).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+function unb64(s) {
+  return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+}
+function utf8(s) { return new TextEncoder().encode(s); }
+
+// Same format as loadUser reads.
+function parseCreds(text) {
+  var re = /[-]{3,}[^\n]*[-]{3,}\n(.+)\n\s*[-]{3,}[^\n]*[-]{3,}\n/g, m, items = [];
+  while ((m = re.exec(text)) !== null) items.push(m[1].trim());
+  return items.length == 2 ? {jwt: items[0], seed: items[1]} : null;
+}
+
+// Seeds are a prefix, the 32 byte Ed25519 seed and a CRC.
+function importSeed(seed) {
+  var pkcs8 = new Uint8Array(48);
+  pkcs8.set([0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x04, 0x22, 0x04, 0x20]);
+  pkcs8.set(b32decode(seed).slice(2, 34), 16);
+  return crypto.subtle.importKey('pkcs8', pkcs8, {name: 'Ed25519'}, false, ['sign']);
+}
+async function sign(bytes) {
+  return new Uint8Array(await crypto.subtle.sign({name: 'Ed25519'}, key, bytes));
+}
+
+async function encodeClaim(c, ttl) {
+  var now = Math.floor(Date.now() / 1000);
+  c.aud = me.aud; c.iss = me.nkey; c.name = me.name;
+  c.iat = now; c.nbf = now; c.exp = now + ttl;
+  var id = await crypto.subtle.digest('SHA-256', utf8(JSON.stringify(c) + Math.random()));
+  c.jti = b32encode(new Uint8Array(id));
+  var h = b64url(utf8(JSON.stringify({typ: 'jwt', alg: 'ed25519'})));
+  var p = b64url(utf8(JSON.stringify(c)));
+  return h + '.' + p + '.' + b64url(await sign(utf8(p)));
+}
+
+function showError(err) { $('error').textContent = err; }
+
+$('credsFile').onchange = function(e) {
+  var r = new FileReader();
+  r.onload = function() { $('creds').value = r.result; };
+  r.readAsText(e.target.files[0]);
+};
+
+$('connect').onclick = async function() {
+  var login = {type: 'login'};
+  if ($('local').checked) {
+    var c = parseCreds($('creds').value);
+    if (!c) return showError('Not a creds file');
+    try {
+      key = await importSeed(c.seed);
+    } catch (e) {
+      return showError('This browser can not sign with Ed25519, uncheck the box to sign on the server: ' + e);
+    }
+    login.jwt = c.jwt;
+  } else {
+    login.creds = $('creds').value;
+  }
+  $('creds').value = '';
+  var proto = location.protocol == 'https:' ? 'wss:' : 'ws:';
+  ws = new WebSocket(proto + '//' + location.host + '/ws');
+  ws.onopen = function() { ws.send(JSON.stringify(login)); };
+  ws.onmessage = function(e) { handle(JSON.parse(e.data)); };
+  ws.onclose = function() {
+    if (me.nkey) showInfo('Disconnected, reload to connect again');
+  };
+};
+
+async function handle(m) {
+  switch (m.type) {
+  case 'sign':
+    ws.send(JSON.stringify({type: 'sig', sig: b64(await sign(unb64(m.nonce)))}));
+    break;
+  case 'welcome':
+    me = m;
+    start();
+    break;
+  case 'post':
+    addPost(m);
+    break;
+  case 'online':
+    if (m.nkey != me.nkey && !users[m.nkey]) {
+      users[m.nkey] = m.name;
+      drawSide();
+    }
+    break;
+  case 'error':
+    if (me.nkey) showInfo(m.error); else showError(m.error);
+    break;
+  }
+}
+
+function start() {
+  $('login').style.display = 'none';
+  $('app').style.display = 'flex';
+  me.channels.forEach(function(ch) { posts['#' + ch] = []; });
+  select('#' + me.channels[0]);
+  if (key) {
+    announce(true);
+    setInterval(function() { announce(false); }, onlineTTL * 500);
+  }
+  $('text').focus();
+}
+
+async function announce(first) {
+  var c = {sub: me.nkey, type: 'chat-online'};
+  if (first) c.tags = ['new'];
+  ws.send(JSON.stringify({type: 'claim', jwt: await encodeClaim(c, onlineTTL)}));
+}
+
+// Conversations are #channel or @nkey.
+function convOf(m) {
+  if (m.channel) return '#' + m.channel;
+  return '@' + (m.nkey == me.nkey ? m.to : m.nkey);
+}
+
+function addPost(m) {
+  var conv = convOf(m);
+  if (conv[0] == '@' && m.nkey != me.nkey && !users[m.nkey]) {
+    users[m.nkey] = m.name;
+  }
+  if (conv[0] == '#' && !posts[conv]) return;
+  var list = posts[conv] || (posts[conv] = []);
+  list.push(m);
+  if (list.length > maxPosts) list.shift();
+  if (conv == cur) {
+    drawPost(m);
+  } else {
+    unread[conv] = true;
+  }
+  drawSide();
+}
+
+function select(conv) {
+  cur = conv;
+  delete unread[conv];
+  $('msgs').textContent = '';
+  (posts[conv] || []).forEach(drawPost);
+  drawSide();
+}
+
+function drawSide() {
+  var item = function(conv, label) {
+    var d = document.createElement('div');
+    d.className = 'item' + (conv == cur ? ' sel' : '') + (unread[conv] ? ' unread' : '');
+    d.textContent = label;
+    d.onclick = function() { select(conv); $('text').focus(); };
+    return d;
+  };
+  $('chans').textContent = '';
+  me.channels.forEach(function(ch) { $('chans').appendChild(item('#' + ch, '# ' + ch)); });
+  $('users').textContent = '';
+  Object.keys(users).sort(function(a, b) { return users[a] < users[b] ? -1 : 1; }).forEach(function(nkey) {
+    $('users').appendChild(item('@' + nkey, users[nkey]));
+  });
+}
+
+function drawPost(m) {
+  var d = document.createElement('div'), when = document.createElement('span'), who = document.createElement('span');
+  d.className = 'msg';
+  when.className = 'when';
+  when.textContent = new Date(m.time * 1000).toTimeString().slice(0, 5);
+  who.className = 'who';
+  var text = document.createElement('span');
+  if (m.msg.indexOf('/me ') == 0) {
+    who.textContent = '*';
+    text.className = 'action';
+    text.textContent = m.name + ' ' + m.msg.slice(4);
+  } else {
+    who.textContent = m.name;
+    text.textContent = m.msg;
+  }
+  d.appendChild(when);
+  d.appendChild(who);
+  d.appendChild(text);
+  $('msgs').appendChild(d);
+  $('msgs').scrollTop = $('msgs').scrollHeight;
+}
+
+function showInfo(text) {
+  var d = document.createElement('div');
+  d.className = 'msg info';
+  d.textContent = '* ' + text;
+  $('msgs').appendChild(d);
+  $('msgs').scrollTop = $('msgs').scrollHeight;
+}
+
+$('text').onkeydown = async function(e) {
+  if (e.key != 'Enter' || e.shiftKey) return;
+  e.preventDefault();
+  var msg = $('text').value;
+  if (msg.trim() == '' || !cur) return;
+  $('text').value = '';
+  var dm = cur[0] == '@', target = cur.slice(1);
+  if (key) {
+    var c = {sub: target, type: dm ? 'chat-dm' : 'chat-post', nats: {msg: msg}};
+    ws.send(JSON.stringify({type: 'claim', jwt: await encodeClaim(c, postTTL)}));
+  } else if (dm) {
+    ws.send(JSON.stringify({type: 'post', to: target, msg: msg}));
+  } else {
+    ws.send(JSON.stringify({type: 'post', channel: target, msg: msg}));
+  }
+};
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,192 @@
+// Copyright 2019-2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcusolsson/tui-go"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultAudience = "KUBECON"
+
+	// Local state of other workspaces is kept apart.
+	workspacesDir = "workspaces"
+)
+
+// workspace is a chat for one audience. Claims carry it as their
+// audience and subjects are under chat.<audience>.
+type workspace struct {
+	Name     string `toml:"name"`
+	Audience string `toml:"audience"`
+	Server   string `toml:"server"`
+	Creds    string `toml:"creds"`
+	Account  string `toml:"account"` // account JWT file, see -acc
+	Channel  string `toml:"channel"`
+
+	// Account JWT files of accounts we share posts with, see federation.go.
+	Remotes []string `toml:"remotes"`
+}
+
+func (ws *workspace) subject(suffix string, args ...interface{}) string {
+	return "chat." + ws.Audience + "." + fmt.Sprintf(suffix, args...)
+}
+
+// Where we keep prefs, the replay cache and the outbox. The
+// default workspace uses the top level, as it always has.
+func (ws *workspace) dataDir() string {
+	if ws.Audience == defaultAudience {
+		return configDir()
+	}
+	return filepath.Join(configDir(), workspacesDir, ws.Audience)
+}
+
+// Fills in what the config leaves out.
+func (ws *workspace) setDefaults(server string) {
+	if ws.Audience == "" {
+		ws.Audience = defaultAudience
+	}
+	ws.Audience = strings.ToUpper(ws.Audience)
+	if ws.Name == "" {
+		ws.Name = ws.Audience
+	}
+	if ws.Server == "" {
+		ws.Server = server
+	}
+	ws.Creds = expandHome(ws.Creds)
+	ws.Account = expandHome(ws.Account)
+	for i, r := range ws.Remotes {
+		ws.Remotes[i] = expandHome(r)
+	}
+}
+
+// app holds the workspaces we are in. Each has its own creds,
+// connection and widgets, and one is shown at a time.
+type app struct {
+	ui     tui.UI
+	config *config
+	spaces []*state
+	cur    int
+
+	// Workspace switcher, in the sidebar of all of them.
+	list *tui.List
+
+	quitOnce sync.Once
+	exitErr  error
+}
+
+func (a *app) active() *state {
+	return a.spaces[a.cur]
+}
+
+// Connects a workspace and announces ourselves.
+func (s *state) connect(name string) {
+	log.Printf("Connecting to %s for %s", s.ws.Server, s.ws.Name)
+	opts := []nats.Option{nats.Name(s.ws.Name + " NATS Chat")}
+	opts = s.setupConnOptions(opts)
+	opts = append(opts, nats.UserCredentials(s.ws.Creds))
+
+	nc, err := nats.Connect(s.ws.Server, opts...)
+	if err != nil {
+		log.Fatalf("Could not connect to %s: %v", s.ws.Name, err)
+	}
+	s.connected(nc)
+	s.setupNATS(nc, name)
+}
+
+// Starts the timers and background work of a connected workspace.
+func (s *state) start() {
+	// Setup expiration timer if the user expires.
+	if s.me.Expires > 0 {
+		expiresInSecs := time.Duration(s.me.Expires - time.Now().Unix())
+		time.AfterFunc(time.Second*expiresInSecs, func() {
+			s.app.quit(fmt.Errorf("Your credentials for %s have expired.", s.ws.Name))
+		})
+	}
+
+	// Remember the claims we have seen across restarts.
+	time.AfterFunc(replaySaveInterval, s.saveReplayCache)
+
+	// Keep the status bar up to date.
+	go s.measureRTT()
+
+	// Send anything left over from last time.
+	go s.flushOutbox()
+}
+
+// Builds the widgets of all workspaces and shows the first.
+func (a *app) setupUI() tui.UI {
+	a.list = tui.NewList()
+	for _, s := range a.spaces {
+		a.list.AddItems(chName(s.ws.Name))
+	}
+	a.list.Select(0)
+
+	ui, err := tui.New(tui.NewSpacer())
+	if err != nil {
+		log.Fatal(err)
+	}
+	theme, _ := a.config.theme()
+	ui.SetTheme(theme)
+	a.ui = ui
+
+	for _, s := range a.spaces {
+		s.ui = ui
+		s.view = s.setupUI()
+	}
+	ui.SetWidget(a.active().view)
+
+	a.list.OnSelectionChanged(func(l *tui.List) { a.show(l.Selected()) })
+	a.setKeybindings()
+	return ui
+}
+
+// Called in the UI goroutine.
+func (a *app) show(i int) {
+	if i < 0 || i >= len(a.spaces) || i == a.cur {
+		return
+	}
+	a.cur = i
+	s := a.active()
+	s.Lock()
+	// Pick up config reloads made while we were hidden.
+	s.setPostsDisplay(s.cur)
+	s.Unlock()
+	a.ui.SetWidget(s.view)
+}
+
+// Switches to the next workspace.
+func (a *app) next() {
+	i := (a.cur + 1) % len(a.spaces)
+	a.list.OnSelectionChanged(nil)
+	a.list.SetSelected(i)
+	a.list.OnSelectionChanged(func(l *tui.List) { a.show(l.Selected()) })
+	a.show(i)
+}
+
+// quit stops the UI, the error if any is shown once the
+// terminal has been restored.
+func (a *app) quit(err error) {
+	a.quitOnce.Do(func() {
+		a.exitErr = err
+		a.ui.Quit()
+	})
+}